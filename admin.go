@@ -0,0 +1,332 @@
+package main
+
+// Local commands for inspecting running proxy with redis-cli: INFO, PROXY STATUS/RULES/STATS, CLIENT LIST
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// time proxy was started
+	startTime = time.Now()
+
+	// all slaves connected to proxy
+	slaveList     = make(map[*slave]bool)
+	slaveListLock sync.Mutex
+	lastSlaveID   int64
+)
+
+// slaveStatus is a state of slave as seen from replication link it is attached to
+type slaveStatus struct {
+	state  string
+	offset int64
+	acked  bool
+}
+
+// Register slave connection, assigning it an ID
+func registerSlave(s *slave) {
+	slaveListLock.Lock()
+	defer slaveListLock.Unlock()
+
+	lastSlaveID++
+	s.id = lastSlaveID
+	s.created = time.Now()
+	slaveList[s] = true
+}
+
+// Forget slave connection when it is closed
+func unregisterSlave(s *slave) {
+	slaveListLock.Lock()
+	defer slaveListLock.Unlock()
+
+	delete(slaveList, s)
+}
+
+// List of connected slaves ordered by ID
+func connectedSlaves() []*slave {
+	slaveListLock.Lock()
+	defer slaveListLock.Unlock()
+
+	result := make([]*slave, 0, len(slaveList))
+	for s := range slaveList {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+
+	return result
+}
+
+// List of running links ordered by ID, link waiting for slaves of other shards is included
+func currentLinks() []*masterLink {
+	activeLock.Lock()
+	result := make([]*masterLink, 0, len(activeLinks)+1)
+	for link := range activeLinks {
+		result = append(result, link)
+	}
+	activeLock.Unlock()
+
+	pendingLock.Lock()
+	if pendingLink != nil {
+		result = append(result, pendingLink)
+	}
+	pendingLock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+
+	return result
+}
+
+// State of slaves attached to links, slaves which aren't replicating are missing
+func slaveStatuses(links []*masterLink) map[*slave]slaveStatus {
+	result := make(map[*slave]slaveStatus)
+
+	for _, link := range links {
+		link.Lock()
+		for _, s := range link.slaves {
+			offset, acked := link.acks[s]
+			result[s] = slaveStatus{state: link.state, offset: offset, acked: acked}
+		}
+		link.Unlock()
+	}
+
+	return result
+}
+
+// Encode bulk string reply
+func encodeBulk(s string) []byte {
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))
+}
+
+// Encode error reply, newlines are replaced so that reply can't be broken
+func encodeError(message string) []byte {
+	return []byte("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(message) + "\r\n")
+}
+
+// Handle command for proxy itself, returns false if command isn't known
+func adminCommand(command []string) ([]byte, bool) {
+	switch strings.ToUpper(command[0]) {
+	case "INFO":
+		if len(command) > 2 {
+			return encodeError("ERR syntax error"), true
+		}
+
+		section := "default"
+		if len(command) == 2 {
+			section = strings.ToLower(command[1])
+		}
+		return encodeBulk(proxyInfo(section)), true
+	case "PROXY":
+		if len(command) != 2 {
+			return encodeError("ERR wrong number of arguments for 'proxy' command"), true
+		}
+
+		switch strings.ToUpper(command[1]) {
+		case "STATUS":
+			return encodeBulk(proxyStatus()), true
+		case "RULES":
+			return encodeRedisCommand(proxyRules()), true
+		case "STATS":
+			var buf bytes.Buffer
+			writeMetrics(&buf)
+			return encodeBulk(buf.String()), true
+		}
+
+		return encodeError(fmt.Sprintf("ERR unknown subcommand '%s'. Try PROXY STATUS, PROXY RULES or PROXY STATS.", command[1])), true
+	case "CLIENT":
+		if len(command) == 2 && strings.ToUpper(command[1]) == "LIST" {
+			return encodeBulk(clientList()), true
+		}
+
+		return encodeError("ERR only CLIENT LIST is supported by proxy"), true
+	}
+
+	return nil, false
+}
+
+// Address of master: address of current connection, or configured address if there's none
+func currentMasterAddr(links []*masterLink) string {
+	for _, link := range links {
+		link.Lock()
+		addr := link.addr
+		link.Unlock()
+
+		if addr != "" {
+			return addr
+		}
+	}
+
+	return net.JoinHostPort(masterHost, strconv.Itoa(masterPort))
+}
+
+// Build reply to INFO command in Redis format, section is one of server, clients, replication,
+// default or all
+func proxyInfo(section string) string {
+	all := section == "default" || section == "all" || section == "everything"
+
+	var buf bytes.Buffer
+	slaves := connectedSlaves()
+	links := currentLinks()
+	statuses := slaveStatuses(links)
+
+	if all || section == "server" {
+		fmt.Fprintf(&buf, "# Server\r\n")
+		fmt.Fprintf(&buf, "redis_mode:resharding-proxy\r\n")
+		fmt.Fprintf(&buf, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(&buf, "uptime_in_seconds:%d\r\n", int64(time.Since(startTime).Seconds()))
+		fmt.Fprintf(&buf, "shards:%s\r\n", shards.String())
+		fmt.Fprintf(&buf, "\r\n")
+	}
+
+	if all || section == "clients" {
+		fmt.Fprintf(&buf, "# Clients\r\n")
+		fmt.Fprintf(&buf, "connected_clients:%d\r\n", len(slaves))
+		fmt.Fprintf(&buf, "\r\n")
+	}
+
+	if all || section == "replication" {
+		fmt.Fprintf(&buf, "# Replication\r\n")
+		fmt.Fprintf(&buf, "role:slave\r\n")
+
+		host, port, _ := net.SplitHostPort(currentMasterAddr(links))
+		fmt.Fprintf(&buf, "master_host:%s\r\n", host)
+		fmt.Fprintf(&buf, "master_port:%s\r\n", port)
+		if len(sentinelAddrs) > 0 {
+			fmt.Fprintf(&buf, "master_name:%s\r\n", sentinelMasterName)
+			fmt.Fprintf(&buf, "sentinels:%s\r\n", strings.Join(sentinelAddrs, ","))
+		}
+
+		linkStatus, syncing := "down", false
+		var (
+			offset   int64
+			progress *RDBProgress
+		)
+
+		for _, link := range links {
+			link.Lock()
+			switch link.state {
+			case "streaming":
+				linkStatus, offset = "up", link.offset
+			case "sync":
+				syncing, progress = true, link.rdbProgress
+			}
+			link.Unlock()
+		}
+
+		fmt.Fprintf(&buf, "master_link_status:%s\r\n", linkStatus)
+		fmt.Fprintf(&buf, "master_repl_offset:%d\r\n", offset)
+
+		if syncing {
+			fmt.Fprintf(&buf, "master_sync_in_progress:1\r\n")
+			if progress != nil {
+				fmt.Fprintf(&buf, "master_sync_total_bytes:%d\r\n", progress.Length)
+				fmt.Fprintf(&buf, "master_sync_read_bytes:%d\r\n", progress.Read)
+				if percent, ok := progress.Percent(); ok {
+					fmt.Fprintf(&buf, "master_sync_perc:%.2f\r\n", percent)
+				}
+				if eta, ok := progress.ETA(); ok {
+					fmt.Fprintf(&buf, "master_sync_eta_seconds:%d\r\n", int64(eta.Seconds()))
+				}
+			}
+		} else {
+			fmt.Fprintf(&buf, "master_sync_in_progress:0\r\n")
+		}
+
+		replicating := 0
+		for _, s := range slaves {
+			status, ok := statuses[s]
+			if !ok {
+				continue
+			}
+
+			host, port, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+			fmt.Fprintf(&buf, "slave%d:ip=%s,port=%s,shard=%s,state=%s,offset=%d\r\n",
+				replicating, host, port, s.shard.addr, status.state, status.offset)
+			replicating++
+		}
+		fmt.Fprintf(&buf, "connected_slaves:%d\r\n", replicating)
+		fmt.Fprintf(&buf, "\r\n")
+	}
+
+	return strings.TrimSuffix(buf.String(), "\r\n")
+}
+
+// Build reply to PROXY STATUS: state of replication links and shards
+func proxyStatus() string {
+	var buf bytes.Buffer
+	slaves := connectedSlaves()
+	links := currentLinks()
+	statuses := slaveStatuses(links)
+
+	fmt.Fprintf(&buf, "master:%s\r\n", currentMasterAddr(links))
+	fmt.Fprintf(&buf, "links:%d\r\n", len(links))
+
+	for _, link := range links {
+		link.Lock()
+		fmt.Fprintf(&buf, "link%d:state=%s,replid=%s,offset=%d,slaves=%d\r\n",
+			link.id, link.state, link.replID, link.offset, len(link.slaves))
+		if link.rdbProgress != nil {
+			fmt.Fprintf(&buf, "link%d_rdb:%s\r\n", link.id, link.rdbProgress)
+		}
+		link.Unlock()
+	}
+
+	for i, sh := range shards {
+		connected, replicating := 0, 0
+		for _, s := range slaves {
+			if s.shard != sh {
+				continue
+			}
+			connected++
+			if _, ok := statuses[s]; ok {
+				replicating++
+			}
+		}
+
+		fmt.Fprintf(&buf, "shard%d:addr=%s,connected=%d,replicating=%d\r\n", i, sh.addr, connected, replicating)
+	}
+
+	return buf.String()
+}
+
+// Build reply to PROXY RULES: filter rules of each shard, one per line, as in -shard option
+func proxyRules() []string {
+	var result []string
+
+	for _, sh := range shards {
+		for _, rule := range sh.rules {
+			result = append(result, fmt.Sprintf("%s %s", sh.addr, rule))
+		}
+	}
+
+	return result
+}
+
+// Build reply to CLIENT LIST: one line for each slave connected to proxy
+func clientList() string {
+	var buf bytes.Buffer
+	statuses := slaveStatuses(currentLinks())
+
+	for _, s := range connectedSlaves() {
+		state, offset := "connected", int64(-1)
+		if status, ok := statuses[s]; ok {
+			state = status.state
+			if status.acked {
+				offset = status.offset
+			}
+		}
+
+		fmt.Fprintf(&buf, "id=%d addr=%s laddr=%s shard=%s age=%d state=%s ack-offset=%d qlen=%d\n",
+			s.id, s.conn.RemoteAddr(), s.conn.LocalAddr(), s.shard.addr, int64(time.Since(s.created).Seconds()),
+			state, offset, len(s.channel))
+	}
+
+	return buf.String()
+}
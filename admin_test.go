@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Read bulk string reply
+func readBulk(t *testing.T, reader *bufio.Reader) string {
+	reply, err := readRedisCommand(reader)
+	if err != nil {
+		t.Fatalf("Unable to read reply: %v", err)
+	}
+	if reply.bulkSize <= 0 {
+		t.Fatalf("Expected bulk reply, got %#v", string(reply.raw))
+	}
+
+	data := make([]byte, reply.bulkSize+2)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		t.Fatalf("Unable to read reply: %v", err)
+	}
+
+	return string(data[:reply.bulkSize])
+}
+
+func TestAdminCommand(t *testing.T) {
+	tests := []struct {
+		command  []string
+		expected string
+	}{
+		{[]string{"INFO", "server", "clients"}, "-ERR syntax error\r\n"},
+		{[]string{"INFO", "unknown"}, "$0\r\n\r\n"},
+		{[]string{"PROXY"}, "-ERR wrong number of arguments for 'proxy' command\r\n"},
+		{[]string{"PROXY", "flush"}, "-ERR unknown subcommand 'flush'. Try PROXY STATUS, PROXY RULES or PROXY STATS.\r\n"},
+		{[]string{"CLIENT", "KILL", "1"}, "-ERR only CLIENT LIST is supported by proxy\r\n"},
+	}
+
+	for _, test := range tests {
+		reply, ok := adminCommand(test.command)
+		if !ok || string(reply) != test.expected {
+			t.Errorf("adminCommand(%#v) = %#v, %v != %#v", test.command, string(reply), ok, test.expected)
+		}
+	}
+
+	if _, ok := adminCommand([]string{"FLUSHALL"}); ok {
+		t.Errorf("FLUSHALL shouldn't be handled by proxy")
+	}
+
+	if string(encodeError("ERR unknown command 'a\r\nb'")) != "-ERR unknown command 'a  b'\r\n" {
+		t.Errorf("Newlines should be removed from error reply")
+	}
+}
+
+func TestAdminInterface(t *testing.T) {
+	shardA := &shard{addr: "admin", rules: []*filterRule{{regexp: regexp.MustCompile("^a_")}}}
+	slots, _ := parseSlots("0-100")
+	shardA.rules = append(shardA.rules, &filterRule{slots: slots, databases: map[int]bool{1: true}})
+	shards = shardList{shardA}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go slaveReader(server, shardA)
+	reader := bufio.NewReader(client)
+
+	client.Write(encodeRedisCommand([]string{"INFO"}))
+	info := readBulk(t, reader)
+	for _, expected := range []string{"# Server\r\n", "shards:admin\r\n", "# Clients\r\n", "role:slave\r\n",
+		"master_link_status:down\r\n", "connected_slaves:0"} {
+		if !strings.Contains(info, expected) {
+			t.Errorf("INFO should contain %#v:\n%s", expected, info)
+		}
+	}
+
+	client.Write(encodeRedisCommand([]string{"info", "replication"}))
+	info = readBulk(t, reader)
+	if !strings.HasPrefix(info, "# Replication\r\n") || strings.Contains(info, "# Server") {
+		t.Errorf("INFO replication should contain only replication section:\n%s", info)
+	}
+
+	client.Write(encodeRedisCommand([]string{"PROXY", "RULES"}))
+	reply, err := readRedisCommand(reader)
+	if err != nil {
+		t.Fatalf("Unable to read reply: %v", err)
+	}
+	if !reflect.DeepEqual(reply.command, []string{"admin ^a_", "admin slots=0-100 db=1"}) {
+		t.Errorf("Unexpected rules: %#v", reply.command)
+	}
+
+	client.Write(encodeRedisCommand([]string{"PROXY", "STATUS"}))
+	status := readBulk(t, reader)
+	if !strings.Contains(status, "shard0:addr=admin,connected=1,replicating=0\r\n") {
+		t.Errorf("Unexpected status:\n%s", status)
+	}
+
+	client.Write(encodeRedisCommand([]string{"PROXY", "STATS"}))
+	stats := readBulk(t, reader)
+	if !strings.Contains(stats, "redis_resharding_proxy_slaves_connected{shard=\"admin\"} 1\n") {
+		t.Errorf("Unexpected stats:\n%s", stats)
+	}
+
+	client.Write(encodeRedisCommand([]string{"CLIENT", "LIST"}))
+	clients := readBulk(t, reader)
+	if !regexp.MustCompile(`(?m)^id=\d+ addr=pipe laddr=pipe shard=admin age=0 state=connected ack-offset=-1 qlen=0$`).MatchString(clients) {
+		t.Errorf("Unexpected client list: %#v", clients)
+	}
+
+	client.Write(encodeRedisCommand([]string{"FOO"}))
+	expectData(t, reader, "-ERR unknown command 'FOO'\r\n")
+}
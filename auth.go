@@ -0,0 +1,83 @@
+package main
+
+// Access control for slaves connecting to proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Check credentials from AUTH command sent by slave: AUTH password or AUTH user password
+func checkAuth(command []string) bool {
+	var user, password string
+
+	switch len(command) {
+	case 2:
+		user, password = "default", command[1]
+	case 3:
+		user, password = command[1], command[2]
+	default:
+		return false
+	}
+
+	expectedUser := proxyUser
+	if expectedUser == "" {
+		expectedUser = "default"
+	}
+
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(expectedUser)) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(proxyPassword)) == 1
+
+	return userOk && passwordOk
+}
+
+// Parse comma-separated list of IP addresses and networks (CIDR)
+func parseAllowlist(list string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+
+	for _, item := range strings.Split(list, ",") {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("Wrong IP address: %#v", item)
+			}
+
+			if ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("Wrong network: %#v", item)
+		}
+
+		result = append(result, network)
+	}
+
+	return result, nil
+}
+
+// Check whether slave is allowed to connect from address
+func clientAllowed(addr net.Addr) bool {
+	if allowedNets == nil {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range allowedNets {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
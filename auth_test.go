@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestCheckAuth(t *testing.T) {
+	defer func() { proxyUser, proxyPassword = "", "" }()
+
+	tests := []struct {
+		user     string
+		command  []string
+		expected bool
+	}{
+		{"", []string{"AUTH", "secret"}, true},
+		{"", []string{"AUTH", "wrong"}, false},
+		{"", []string{"AUTH", "default", "secret"}, true},
+		{"", []string{"AUTH", "replica", "secret"}, false},
+		{"replica", []string{"AUTH", "replica", "secret"}, true},
+		{"replica", []string{"AUTH", "secret"}, false},
+		{"", []string{"AUTH"}, false},
+	}
+
+	for _, test := range tests {
+		proxyUser, proxyPassword = test.user, "secret"
+
+		if checkAuth(test.command) != test.expected {
+			t.Errorf("checkAuth(%#v) with user %#v != %v", test.command, test.user, test.expected)
+		}
+	}
+}
+
+func TestClientAllowed(t *testing.T) {
+	defer func() { allowedNets = nil }()
+
+	if !clientAllowed(&net.TCPAddr{IP: net.ParseIP("8.8.8.8")}) {
+		t.Errorf("all clients should be allowed without allowlist")
+	}
+
+	var err error
+	allowedNets, err = parseAllowlist("10.0.0.0/8,192.168.1.10,::1")
+	if err != nil {
+		t.Fatalf("Unable to parse allowlist: %v", err)
+	}
+
+	tests := []struct {
+		addr     net.Addr
+		expected bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.10")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.11")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("8.8.8.8")}, false},
+		{&net.UnixAddr{Name: "/tmp/sock"}, false},
+	}
+
+	for _, test := range tests {
+		if clientAllowed(test.addr) != test.expected {
+			t.Errorf("clientAllowed(%s) != %v", test.addr, test.expected)
+		}
+	}
+
+	for _, list := range []string{"", "10.0.0.0/33", "host", "10.0.0.1,"} {
+		_, err = parseAllowlist(list)
+		if err == nil {
+			t.Errorf("Parsing allowlist %#v should fail", list)
+		}
+	}
+}
+
+func TestSlaveAuth(t *testing.T) {
+	proxyPassword = "secret"
+	defer func() { proxyPassword = "" }()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go slaveReader(server, &shard{addr: "a"})
+	reader := bufio.NewReader(client)
+
+	client.Write(encodeRedisCommand([]string{"SYNC"}))
+	expectData(t, reader, "-NOAUTH Authentication required.\r\n")
+
+	client.Write(encodeRedisCommand([]string{"AUTH", "wrong"}))
+	expectData(t, reader, "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+
+	client.Write(encodeRedisCommand([]string{"AUTH", "secret"}))
+	expectData(t, reader, "+OK\r\n")
+
+	client.Write(encodeRedisCommand([]string{"PING"}))
+	expectData(t, reader, "+PONG\r\n")
+}
@@ -0,0 +1,337 @@
+package main
+
+// Keys of replicated commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// commandClass defines how replicated command is passed to slaves
+type commandClass int
+
+const (
+	// command is filtered by its keys
+	commandKeyed commandClass = iota
+	// command is passed to all slaves
+	commandBroadcast
+	// command is never passed to slaves
+	commandDrop
+)
+
+// Names of command classes as used in -command-policy option
+var commandClassNames = map[string]commandClass{
+	"keyed":     commandKeyed,
+	"broadcast": commandBroadcast,
+	"drop":      commandDrop,
+}
+
+// Commands which are essential for replication protocol, their class can't be changed
+var protocolCommands = map[string]bool{
+	"PING":     true,
+	"REPLCONF": true,
+	"MULTI":    true,
+	"EXEC":     true,
+	"DISCARD":  true,
+	"SELECT":   true,
+}
+
+// commandSpec describes positions of keys in command arguments (like in Redis command table):
+// keys are at positions firstKey, firstKey+keyStep, ... up to lastKey (negative lastKey counts from the end),
+// if numKeys is set, argument at that position contains number of keys which follow it
+type commandSpec struct {
+	class    commandClass
+	firstKey int
+	lastKey  int
+	keyStep  int
+	numKeys  int
+	// command could be split into several commands, each with part of keys (keyStep arguments per key)
+	split bool
+}
+
+var (
+	singleKeySpec = &commandSpec{firstKey: 1, lastKey: 1, keyStep: 1}
+	keylessSpec   = &commandSpec{class: commandBroadcast}
+)
+
+// Specs of replicated commands which don't have single key as the first argument
+var commandSpecs = map[string]*commandSpec{
+	"PING":     keylessSpec,
+	"REPLCONF": keylessSpec,
+	"MULTI":    keylessSpec,
+	"EXEC":     keylessSpec,
+	"DISCARD":  keylessSpec,
+	"SELECT":   keylessSpec,
+	"SCRIPT":   keylessSpec,
+	"FUNCTION": keylessSpec,
+	"FLUSHALL": keylessSpec,
+	"FLUSHDB":  keylessSpec,
+	"SWAPDB":   keylessSpec,
+	"PUBLISH":  keylessSpec,
+
+	"DEL":    {firstKey: 1, lastKey: -1, keyStep: 1, split: true},
+	"UNLINK": {firstKey: 1, lastKey: -1, keyStep: 1, split: true},
+	"TOUCH":  {firstKey: 1, lastKey: -1, keyStep: 1, split: true},
+	"MSET":   {firstKey: 1, lastKey: -1, keyStep: 2, split: true},
+	"MSETNX": {firstKey: 1, lastKey: -1, keyStep: 2},
+
+	"RENAME":         {firstKey: 1, lastKey: 2, keyStep: 1},
+	"RENAMENX":       {firstKey: 1, lastKey: 2, keyStep: 1},
+	"COPY":           {firstKey: 1, lastKey: 2, keyStep: 1},
+	"SMOVE":          {firstKey: 1, lastKey: 2, keyStep: 1},
+	"RPOPLPUSH":      {firstKey: 1, lastKey: 2, keyStep: 1},
+	"LMOVE":          {firstKey: 1, lastKey: 2, keyStep: 1},
+	"GEOSEARCHSTORE": {firstKey: 1, lastKey: 2, keyStep: 1},
+
+	"SUNIONSTORE": {firstKey: 1, lastKey: -1, keyStep: 1},
+	"SINTERSTORE": {firstKey: 1, lastKey: -1, keyStep: 1},
+	"SDIFFSTORE":  {firstKey: 1, lastKey: -1, keyStep: 1},
+	"PFMERGE":     {firstKey: 1, lastKey: -1, keyStep: 1},
+	"BITOP":       {firstKey: 2, lastKey: -1, keyStep: 1},
+
+	"ZUNIONSTORE": {firstKey: 1, lastKey: 1, keyStep: 1, numKeys: 2},
+	"ZINTERSTORE": {firstKey: 1, lastKey: 1, keyStep: 1, numKeys: 2},
+	"ZDIFFSTORE":  {firstKey: 1, lastKey: 1, keyStep: 1, numKeys: 2},
+	"ZRANGESTORE": {firstKey: 1, lastKey: 2, keyStep: 1},
+	"LMPOP":       {numKeys: 1},
+	"ZMPOP":       {numKeys: 1},
+	"SINTERCARD":  {numKeys: 1},
+
+	// scripts declare keys they access: EVAL script numkeys key... arg...
+	"EVAL":       {numKeys: 2},
+	"EVALSHA":    {numKeys: 2},
+	"EVAL_RO":    {numKeys: 2},
+	"EVALSHA_RO": {numKeys: 2},
+	"FCALL":      {numKeys: 2},
+	"FCALL_RO":   {numKeys: 2},
+
+	// XGROUP CREATE|SETID|DESTROY|CREATECONSUMER|DELCONSUMER key group ...,
+	// also replicated by master on behalf of XREADGROUP and XAUTOCLAIM
+	"XGROUP": {firstKey: 2, lastKey: 2, keyStep: 1},
+}
+
+// Find spec for the command, taking -command-policy into account
+func lookupCommandSpec(command []string) *commandSpec {
+	name := strings.ToUpper(command[0])
+
+	spec, exists := commandSpecs[name]
+	if !exists {
+		spec = singleKeySpec
+	}
+
+	class, exists := commandPolicy[name]
+	if !exists || class == spec.class {
+		return spec
+	}
+
+	if class == commandKeyed && spec.firstKey == 0 && spec.numKeys == 0 {
+		return singleKeySpec
+	}
+
+	override := *spec
+	override.class = class
+	return &override
+}
+
+// Parse policy "COMMAND=class,..." which overrides built-in classification of commands
+func parseCommandPolicy(list string) (map[string]commandClass, error) {
+	result := make(map[string]commandClass)
+
+	for _, item := range strings.Split(list, ",") {
+		pair := strings.Split(item, "=")
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("Command policy should be specified as \"COMMAND=class\": %#v", item)
+		}
+
+		name := strings.ToUpper(pair[0])
+		if protocolCommands[name] {
+			return nil, fmt.Errorf("Policy for command %s can't be changed", name)
+		}
+
+		class, exists := commandClassNames[strings.ToLower(pair[1])]
+		if !exists {
+			return nil, fmt.Errorf("Command class should be one of keyed, broadcast or drop: %#v", pair[1])
+		}
+
+		result[name] = class
+	}
+
+	return result, nil
+}
+
+// Find positions of keys in the command
+func commandKeys(command []string) []int {
+	spec := lookupCommandSpec(command)
+
+	var result []int
+
+	if spec.firstKey > 0 {
+		last := spec.lastKey
+		if last < 0 {
+			last += len(command)
+		}
+		if last >= len(command) {
+			last = len(command) - 1
+		}
+
+		for i := spec.firstKey; i <= last; i += spec.keyStep {
+			result = append(result, i)
+		}
+	}
+
+	if spec.numKeys > 0 && spec.numKeys < len(command) {
+		n, err := strconv.Atoi(command[spec.numKeys])
+		if err == nil {
+			for i := spec.numKeys + 1; i <= spec.numKeys+n && i < len(command); i++ {
+				result = append(result, i)
+			}
+		}
+	}
+
+	return result
+}
+
+// Filter command keys for slave with key filter match: result is the command which should be sent to slave
+// (nil if command should be dropped), rewritten is true if command was split to contain only matching keys,
+// conflict is true if command touches both matching and non-matching keys, but can't be split
+func filterCommandKeys(command []string, match func(string) bool) (result []string, rewritten bool, conflict bool) {
+	switch lookupCommandSpec(command).class {
+	case commandDrop:
+		return nil, false, false
+	case commandBroadcast:
+		return command, false, false
+	}
+
+	keys := commandKeys(command)
+	if len(keys) == 0 {
+		return command, false, false
+	}
+
+	matched := 0
+	for _, position := range keys {
+		if match(command[position]) {
+			matched++
+		}
+	}
+
+	if matched == 0 {
+		return nil, false, false
+	}
+
+	if matched == len(keys) {
+		return command, false, false
+	}
+
+	spec := lookupCommandSpec(command)
+	if !spec.split {
+		// pass whole command to slave, as some of the keys belong to it
+		return command, false, true
+	}
+
+	result = []string{command[0]}
+	for _, position := range keys {
+		if match(command[position]) {
+			end := position + spec.keyStep
+			if end > len(command) {
+				end = len(command)
+			}
+			result = append(result, command[position:end]...)
+		}
+	}
+
+	return result, true, false
+}
+
+// Rewrite database numbers in command (SELECT, MOVE, SWAPDB, COPY ... DB) according to mapping,
+// returns rewritten command and true if any database number was changed
+func remapCommandDB(command []string, mapping map[int]int) ([]string, bool) {
+	if len(mapping) == 0 {
+		return command, false
+	}
+
+	var positions []int
+
+	switch strings.ToUpper(command[0]) {
+	case "SELECT":
+		positions = []int{1}
+	case "MOVE":
+		positions = []int{2}
+	case "SWAPDB":
+		positions = []int{1, 2}
+	case "COPY":
+		for i := 3; i < len(command)-1; i++ {
+			if strings.ToUpper(command[i]) == "DB" {
+				positions = append(positions, i+1)
+			}
+		}
+	}
+
+	var result []string
+
+	for _, position := range positions {
+		if position >= len(command) {
+			continue
+		}
+
+		db, err := strconv.Atoi(command[position])
+		if err != nil {
+			continue
+		}
+
+		mapped, exists := mapping[db]
+		if !exists {
+			continue
+		}
+
+		if result == nil {
+			result = append([]string(nil), command...)
+		}
+		result[position] = strconv.Itoa(mapped)
+	}
+
+	if result == nil {
+		return command, false
+	}
+
+	return result, true
+}
+
+// Transformation of keys according to -key-prefix-strip and -key-prefix-add options, nil if keys are passed as is
+func keyTransform() func(string) string {
+	if keyPrefixAdd == "" && keyPrefixStrip == "" {
+		return nil
+	}
+
+	add, strip := keyPrefixAdd, keyPrefixStrip
+	return func(key string) string {
+		return add + strings.TrimPrefix(key, strip)
+	}
+}
+
+// Apply transform to all keys of the command, returns rewritten command and true if any key was changed
+func transformCommandKeys(command []string, transform func(string) string) ([]string, bool) {
+	if transform == nil {
+		return command, false
+	}
+
+	var result []string
+
+	for _, position := range commandKeys(command) {
+		key := transform(command[position])
+		if key == command[position] {
+			continue
+		}
+
+		if result == nil {
+			result = append([]string(nil), command...)
+		}
+		result[position] = key
+	}
+
+	if result == nil {
+		return command, false
+	}
+
+	return result, true
+}
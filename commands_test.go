@@ -0,0 +1,175 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		command []string
+		keys    []int
+	}{
+		{[]string{"SET", "mykey", "myvalue"}, []int{1}},
+		{[]string{"PING"}, nil},
+		{[]string{"XADD", "events", "*", "field", "value"}, []int{1}},
+		{[]string{"XCLAIM", "events", "group", "consumer", "0", "1526569498055-0"}, []int{1}},
+		{[]string{"XGROUP", "CREATE", "events", "group", "$"}, []int{2}},
+		{[]string{"xgroup", "SETID", "events", "group", "0"}, []int{2}},
+		{[]string{"XGROUP", "HELP"}, nil},
+		{[]string{"DEL", "a", "b", "c"}, []int{1, 2, 3}},
+		{[]string{"MSET", "a", "1", "b", "2"}, []int{1, 3}},
+		{[]string{"RENAME", "a", "b"}, []int{1, 2}},
+		{[]string{"BITOP", "AND", "dest", "a", "b"}, []int{2, 3, 4}},
+		{[]string{"ZUNIONSTORE", "dest", "2", "a", "b", "WEIGHTS", "1", "2"}, []int{1, 3, 4}},
+		{[]string{"LMPOP", "2", "a", "b", "LEFT"}, []int{2, 3}},
+		{[]string{"ZINTERSTORE", "dest", "x", "a"}, []int{1}},
+		{[]string{"EVAL", "return 1", "2", "a", "b", "arg"}, []int{3, 4}},
+		{[]string{"evalsha", "e0e1f9fabfc9d4800c877a703b823ac0578ff8db", "0", "arg"}, nil},
+		{[]string{"FCALL", "myfunc", "1", "a"}, []int{3}},
+		{[]string{"SCRIPT", "LOAD", "return 1"}, nil},
+		{[]string{"FUNCTION", "LOAD", "#!lua name=mylib"}, nil},
+	}
+
+	for _, test := range tests {
+		keys := commandKeys(test.command)
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("commandKeys(%#v) = %#v != %#v", test.command, keys, test.keys)
+		}
+	}
+}
+
+func TestFilterCommandKeys(t *testing.T) {
+	match := func(key string) bool { return strings.HasPrefix(key, "a") }
+
+	tests := []struct {
+		command   []string
+		result    []string
+		rewritten bool
+		conflict  bool
+	}{
+		{[]string{"SET", "aaa", "1"}, []string{"SET", "aaa", "1"}, false, false},
+		{[]string{"SET", "bbb", "1"}, nil, false, false},
+		{[]string{"PING"}, []string{"PING"}, false, false},
+		{[]string{"DEL", "a1", "b1", "a2"}, []string{"DEL", "a1", "a2"}, true, false},
+		{[]string{"DEL", "b1", "b2"}, nil, false, false},
+		{[]string{"UNLINK", "a1", "a2"}, []string{"UNLINK", "a1", "a2"}, false, false},
+		{[]string{"MSET", "b1", "1", "a1", "2", "b2", "3"}, []string{"MSET", "a1", "2"}, true, false},
+		{[]string{"mset", "a1", "1", "b1", "2"}, []string{"mset", "a1", "1"}, true, false},
+		{[]string{"MSETNX", "a1", "1", "b1", "2"}, []string{"MSETNX", "a1", "1", "b1", "2"}, false, true},
+		{[]string{"RENAME", "a1", "b1"}, []string{"RENAME", "a1", "b1"}, false, true},
+		{[]string{"RENAME", "b1", "b2"}, nil, false, false},
+		{[]string{"ZUNIONSTORE", "a1", "2", "b1", "a2"}, []string{"ZUNIONSTORE", "a1", "2", "b1", "a2"}, false, true},
+		{[]string{"EVAL", "script", "1", "b1"}, nil, false, false},
+		{[]string{"EVAL", "script", "2", "a1", "a2", "b3"}, []string{"EVAL", "script", "2", "a1", "a2", "b3"}, false, false},
+		{[]string{"EVALSHA", "sha", "2", "a1", "b2"}, []string{"EVALSHA", "sha", "2", "a1", "b2"}, false, true},
+		{[]string{"SCRIPT", "LOAD", "bbb"}, []string{"SCRIPT", "LOAD", "bbb"}, false, false},
+		{[]string{"FLUSHALL", "ASYNC"}, []string{"FLUSHALL", "ASYNC"}, false, false},
+		{[]string{"FLUSHDB"}, []string{"FLUSHDB"}, false, false},
+		{[]string{"SWAPDB", "0", "1"}, []string{"SWAPDB", "0", "1"}, false, false},
+		{[]string{"PUBLISH", "bbb", "message"}, []string{"PUBLISH", "bbb", "message"}, false, false},
+	}
+
+	for _, test := range tests {
+		result, rewritten, conflict := filterCommandKeys(test.command, match)
+		if !reflect.DeepEqual(result, test.result) || rewritten != test.rewritten || conflict != test.conflict {
+			t.Errorf("filterCommandKeys(%#v) = %#v, %v, %v != %#v, %v, %v", test.command, result, rewritten, conflict,
+				test.result, test.rewritten, test.conflict)
+		}
+	}
+}
+
+func TestRemapCommandDB(t *testing.T) {
+	mapping := map[int]int{0: 3, 1: 4}
+
+	tests := []struct {
+		command  []string
+		result   []string
+		remapped bool
+	}{
+		{[]string{"SELECT", "0"}, []string{"SELECT", "3"}, true},
+		{[]string{"select", "1"}, []string{"select", "4"}, true},
+		{[]string{"SELECT", "2"}, []string{"SELECT", "2"}, false},
+		{[]string{"SET", "0", "1"}, []string{"SET", "0", "1"}, false},
+		{[]string{"MOVE", "key", "1"}, []string{"MOVE", "key", "4"}, true},
+		{[]string{"SWAPDB", "0", "2"}, []string{"SWAPDB", "3", "2"}, true},
+		{[]string{"COPY", "a", "b", "DB", "0", "REPLACE"}, []string{"COPY", "a", "b", "DB", "3", "REPLACE"}, true},
+	}
+
+	for _, test := range tests {
+		result, remapped := remapCommandDB(test.command, mapping)
+		if !reflect.DeepEqual(result, test.result) || remapped != test.remapped {
+			t.Errorf("remapCommandDB(%#v) = %#v, %v != %#v, %v", test.command, result, remapped, test.result, test.remapped)
+		}
+	}
+}
+
+func TestTransformCommandKeys(t *testing.T) {
+	keyPrefixStrip, keyPrefixAdd = "old:", "new:"
+	defer func() { keyPrefixStrip, keyPrefixAdd = "", "" }()
+
+	transform := keyTransform()
+
+	tests := []struct {
+		command []string
+		result  []string
+		renamed bool
+	}{
+		{[]string{"SET", "old:a", "old:b"}, []string{"SET", "new:a", "old:b"}, true},
+		{[]string{"SET", "a", "1"}, []string{"SET", "new:a", "1"}, true},
+		{[]string{"PING"}, []string{"PING"}, false},
+		{[]string{"MSET", "old:a", "1", "b", "2"}, []string{"MSET", "new:a", "1", "new:b", "2"}, true},
+		{[]string{"XGROUP", "CREATE", "old:s", "old:g", "$"}, []string{"XGROUP", "CREATE", "new:s", "old:g", "$"}, true},
+	}
+
+	for _, test := range tests {
+		result, renamed := transformCommandKeys(test.command, transform)
+		if !reflect.DeepEqual(result, test.result) || renamed != test.renamed {
+			t.Errorf("transformCommandKeys(%#v) = %#v, %v != %#v, %v", test.command, result, renamed, test.result, test.renamed)
+		}
+	}
+
+	keyPrefixStrip, keyPrefixAdd = "", ""
+	if keyTransform() != nil {
+		t.Errorf("keyTransform() should be nil without prefixes")
+	}
+}
+
+func TestCommandPolicy(t *testing.T) {
+	var err error
+
+	commandPolicy, err = parseCommandPolicy("flushall=drop,PUBLISH=keyed,SET=broadcast")
+	defer func() { commandPolicy = nil }()
+	if err != nil {
+		t.Fatalf("Unable to parse command policy: %v", err)
+	}
+
+	match := func(key string) bool { return strings.HasPrefix(key, "a") }
+
+	tests := []struct {
+		command []string
+		result  []string
+	}{
+		{[]string{"FLUSHALL"}, nil},
+		{[]string{"FLUSHDB"}, []string{"FLUSHDB"}},
+		{[]string{"PUBLISH", "aaa", "message"}, []string{"PUBLISH", "aaa", "message"}},
+		{[]string{"PUBLISH", "bbb", "message"}, nil},
+		{[]string{"SET", "bbb", "1"}, []string{"SET", "bbb", "1"}},
+		{[]string{"INCR", "bbb"}, nil},
+	}
+
+	for _, test := range tests {
+		result, _, _ := filterCommandKeys(test.command, match)
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("filterCommandKeys(%#v) = %#v != %#v", test.command, result, test.result)
+		}
+	}
+
+	for _, list := range []string{"", "FLUSHALL", "FLUSHALL=ignore", "=drop", "SELECT=drop", "multi=keyed"} {
+		_, err = parseCommandPolicy(list)
+		if err == nil {
+			t.Errorf("Parsing command policy %#v should fail", list)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	crc := CRC16([]byte{'1', '2', '3', '4', '5', '6', '7', '8', '9'})
+	if crc != 0x31c3 {
+		t.Errorf("crc16 doesn't match: crc16(\"123456789\") = %#v != 0x31c3", crc)
+	}
+}
+
+func BenchmarkCRC16(b *testing.B) {
+	data := []byte{'1', '2', '3', '4', '5', '6', '7', '8', '9'}
+	for i := 0; i < b.N; i++ {
+		CRC16(data)
+	}
+}
@@ -2,37 +2,60 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	masterPort int
-	masterHost string
-	proxyPort  int
-	proxyHost  string
-	keyRegexp  *regexp.Regexp
+	masterPort        int
+	masterHost        string
+	masterUser        string
+	masterPassword    string
+	proxyPort         int
+	proxyHost         string
+	proxyUser         string
+	proxyPassword     string
+	allowedNets       []*net.IPNet
+	spoolDir          string
+	syncDelay         time.Duration
+	reconnectDelay    time.Duration
+	reconnectMaxDelay time.Duration
+	dbMap             map[int]int
+
+	keyPrefixAdd   string
+	keyPrefixStrip string
+
+	commandPolicy map[string]commandClass
 )
 
 const (
-	bufSize       = 16384
-	channelBuffer = 100
+	bufSize           = 16384
+	channelBuffer     = 100
+	keepaliveInterval = time.Second
 )
 
 type redisCommand struct {
-	raw      []byte
-	command  []string
-	reply    string
-	bulkSize int64
+	raw        []byte
+	command    []string
+	reply      string
+	errorReply string
+	bulkSize   int64
+	eofMark    []byte
 }
 
+// Length of EOF mark used in diskless replication
+const eofMarkSize = 40
+
 func readRedisCommand(reader *bufio.Reader) (*redisCommand, error) {
 	header, err := reader.ReadString('\n')
 	if err != nil {
@@ -48,6 +71,18 @@ func readRedisCommand(reader *bufio.Reader) (*redisCommand, error) {
 		return &redisCommand{raw: []byte(header), reply: strings.TrimSpace(header[1:])}, nil
 	}
 
+	if strings.HasPrefix(header, "-") {
+		return &redisCommand{raw: []byte(header), errorReply: strings.TrimSpace(header[1:])}, nil
+	}
+
+	if strings.HasPrefix(header, "$EOF:") {
+		eofMark := strings.TrimSpace(header[5:])
+		if len(eofMark) != eofMarkSize {
+			return nil, fmt.Errorf("Unable to decode EOF mark: %#v", eofMark)
+		}
+		return &redisCommand{raw: []byte(header), eofMark: []byte(eofMark)}, nil
+	}
+
 	if strings.HasPrefix(header, "$") {
 		bulkSize, err := strconv.ParseInt(strings.TrimSpace(header[1:]), 10, 64)
 		if err != nil {
@@ -101,6 +136,19 @@ func readRedisCommand(reader *bufio.Reader) (*redisCommand, error) {
 	return &redisCommand{raw: []byte(header), command: []string{strings.TrimSpace(header)}}, nil
 }
 
+// Encode command in Redis unified protocol
+func encodeRedisCommand(command []string) []byte {
+	result := []byte(fmt.Sprintf("*%d\r\n", len(command)))
+
+	for _, argument := range command {
+		result = append(result, []byte(fmt.Sprintf("$%d\r\n", len(argument)))...)
+		result = append(result, []byte(argument)...)
+		result = append(result, '\r', '\n')
+	}
+
+	return result
+}
+
 // Goroutine that handles writing commands to master
 func masterWriter(conn net.Conn, masterchannel <-chan []byte) {
 	defer conn.Close()
@@ -109,72 +157,150 @@ func masterWriter(conn net.Conn, masterchannel <-chan []byte) {
 		_, err := conn.Write(data)
 		if err != nil {
 			log.Printf("Failed to write data to master: %v\n", err)
-			return
+			break
 		}
 	}
+
+	// drain channel, so that writers never block
+	for _ = range masterchannel {
+	}
+}
+
+// slave is Redis slave connected to the proxy
+type slave struct {
+	id         int64
+	created    time.Time
+	conn       net.Conn
+	shard      *shard
+	link       *masterLink
+	offsets    *offsetMap
+	channel    chan []byte
+	done       chan bool
+	psync      bool
+	capaEOF    bool
+	capaPSYNC2 bool
+}
+
+// Send data to slave, nil data flushes output buffer
+func (s *slave) send(data []byte) bool {
+	select {
+	case s.channel <- data:
+		return true
+	case <-s.done:
+		return false
+	}
 }
 
-// Connect to master, request replication and filter it
-func masterConnection(slavechannel chan<- []byte, masterchannel <-chan []byte) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", masterHost, masterPort))
+// Send filtered RDB to slave: RDB is streamed with EOF mark if slave supports it,
+// otherwise it is spooled to find out its exact length
+func (s *slave) sendRDB(rdbchannel <-chan []byte) error {
+	if !s.capaEOF {
+		return s.spoolRDB(rdbchannel)
+	}
+
+	mark := make([]byte, eofMarkSize/2)
+	_, err := rand.Read(mark)
 	if err != nil {
-		log.Printf("Failed to connect to master: %v\n", err)
-		return
+		return err
 	}
+	eofMark := []byte(hex.EncodeToString(mark))
 
-	defer conn.Close()
-	go masterWriter(conn, masterchannel)
+	s.send([]byte(fmt.Sprintf("$EOF:%s\r\n", eofMark)))
 
-	reader := bufio.NewReaderSize(conn, bufSize)
+	for data := range rdbchannel {
+		s.send(data)
+	}
 
-	for {
-		command, err := readRedisCommand(reader)
-		if err != nil {
-			log.Printf("Error while reading from master: %v\n", err)
-			return
-		}
+	s.send(eofMark)
+	s.send(nil)
 
-		if command.reply != "" || command.command == nil && command.bulkSize == 0 {
-			// passthrough reply & empty command
-			slavechannel <- command.raw
-			slavechannel <- nil
-		} else if len(command.command) == 1 && command.command[0] == "PING" {
-			log.Println("Got PING from master")
+	return nil
+}
 
-			slavechannel <- command.raw
-			slavechannel <- nil
-		} else if command.bulkSize > 0 {
-			// RDB Transfer
+// Filter RDB into temporary file, as length of filtered RDB isn't known in advance.
+// Slave is kept alive with newlines while RDB is being filtered,
+// afterwards filtered RDB is sent to slave with exact length
+func (s *slave) spoolRDB(rdbchannel <-chan []byte) error {
+	file, err := ioutil.TempFile(spoolDir, "redis-resharding-proxy")
+	if err != nil {
+		for _ = range rdbchannel {
+		}
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+
+	var (
+		filteredLength int64
+		writeErr       error
+	)
+
+	for rdbchannel != nil {
+		select {
+		case data, ok := <-rdbchannel:
+			if !ok {
+				rdbchannel = nil
+				break
+			}
+			if writeErr == nil {
+				_, writeErr = file.Write(data)
+				filteredLength += int64(len(data))
+			}
+		case <-ticker.C:
+			s.send([]byte("\n"))
+			s.send(nil)
+		}
+	}
 
-			log.Printf("RDB size: %d\n", command.bulkSize)
+	if writeErr != nil {
+		return writeErr
+	}
 
-			slavechannel <- command.raw
+	log.Printf("Filtered RDB size: %d\n", filteredLength)
 
-			err = FilterRDB(reader, slavechannel, func(key string) bool { return keyRegexp.FindStringIndex(key) != nil }, command.bulkSize)
-			if err != nil {
-				log.Printf("Unable to read RDB: %v\n", err)
-				return
-			}
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return err
+	}
 
-			log.Println("RDB filtering finished, filtering commands...")
-		} else {
-			if len(command.command) >= 2 && keyRegexp.FindStringIndex(command.command[1]) == nil {
-				continue
-			}
+	s.send([]byte(fmt.Sprintf("$%d\r\n", filteredLength)))
 
-			slavechannel <- command.raw
-			slavechannel <- nil
+	for {
+		data := make([]byte, bufSize)
+		n, err := file.Read(data)
+		if n > 0 {
+			s.send(data[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
 		}
-
 	}
+
+	s.send(nil)
+	return nil
 }
 
 // Goroutine that handles writing data back to slave
-func slaveWriter(conn net.Conn, slavechannel <-chan []byte) {
-	writer := bufio.NewWriterSize(conn, bufSize)
+func slaveWriter(s *slave) {
+	writer := bufio.NewWriterSize(s.conn, bufSize)
 
-	for data := range slavechannel {
-		var err error
+	for {
+		var (
+			data []byte
+			err  error
+		)
+
+		select {
+		case data = <-s.channel:
+		case <-s.done:
+			return
+		}
 
 		if data == nil {
 			err = writer.Flush()
@@ -184,29 +310,43 @@ func slaveWriter(conn net.Conn, slavechannel <-chan []byte) {
 
 		if err != nil {
 			log.Printf("Failed to write data to slave: %v\n", err)
+			s.conn.Close()
 			return
 		}
 	}
 }
 
 // Read commands from slave
-func slaveReader(conn net.Conn) {
+func slaveReader(conn net.Conn, sh *shard) {
 	defer conn.Close()
 
-	log.Print("Slave connection established from ", conn.RemoteAddr().String())
+	log.Printf("Slave connection established from %s to %s\n", conn.RemoteAddr(), sh.addr)
+
+	slavesConnected.add(1, sh.addr)
+	defer slavesConnected.add(-1, sh.addr)
 
 	reader := bufio.NewReaderSize(conn, bufSize)
 
-	// channel for writing to slave
-	slavechannel := make(chan []byte, channelBuffer)
-	defer close(slavechannel)
+	s := &slave{
+		conn:    conn,
+		shard:   sh,
+		channel: make(chan []byte, channelBuffer),
+		done:    make(chan bool),
+	}
+	defer close(s.done)
+
+	registerSlave(s)
+	defer unregisterSlave(s)
 
-	// channel for writing to master
-	masterchannel := make(chan []byte, channelBuffer)
-	defer close(masterchannel)
+	go slaveWriter(s)
+
+	defer func() {
+		if s.link != nil {
+			s.link.detach(s)
+		}
+	}()
 
-	go slaveWriter(conn, slavechannel)
-	go masterConnection(slavechannel, masterchannel)
+	authenticated := proxyPassword == ""
 
 	for {
 		command, err := readRedisCommand(reader)
@@ -215,64 +355,265 @@ func slaveReader(conn net.Conn) {
 			return
 		}
 
-		if command.reply != "" || command.command == nil && command.bulkSize == 0 {
-			// passthrough reply & empty command
-			masterchannel <- command.raw
-		} else if len(command.command) == 1 && command.command[0] == "PING" {
+		if len(command.command) == 0 {
+			// ignore replies & empty commands
+			continue
+		}
+
+		name := strings.ToUpper(command.command[0])
+
+		if name == "AUTH" {
+			if proxyPassword == "" {
+				s.send([]byte("-ERR AUTH called without any password configured\r\n"))
+			} else if checkAuth(command.command) {
+				authenticated = true
+				s.send([]byte("+OK\r\n"))
+			} else {
+				log.Printf("Authentication failed for slave %s\n", conn.RemoteAddr())
+				s.send([]byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n"))
+			}
+			s.send(nil)
+		} else if !authenticated {
+			s.send([]byte("-NOAUTH Authentication required.\r\n"))
+			s.send(nil)
+		} else if len(command.command) == 1 && name == "PING" {
 			log.Println("Got PING from slave")
 
-			masterchannel <- command.raw
-		} else if len(command.command) == 1 && command.command[0] == "SYNC" {
+			s.send([]byte("+PONG\r\n"))
+			s.send(nil)
+		} else if (name == "SYNC" || name == "PSYNC") && s.link != nil {
+			log.Println("Slave is already replicating, ignoring", name)
+		} else if len(command.command) == 1 && name == "SYNC" {
 			log.Println("Starting SYNC")
 
-			masterchannel <- command.raw
-		} else if len(command.command) == 3 && command.command[0] == "REPLCONF" && command.command[1] == "ACK" {
+			syncSlave(s)
+		} else if len(command.command) == 3 && name == "PSYNC" {
+			log.Printf("Starting PSYNC with replication ID %s at offset %s\n", command.command[1], command.command[2])
+
+			s.psync = true
+
+			offset, err := strconv.ParseInt(command.command[2], 10, 64)
+			if err != nil {
+				syncSlave(s)
+			} else {
+				psyncSlave(s, command.command[1], offset)
+			}
+		} else if len(command.command) >= 3 && name == "REPLCONF" && strings.ToUpper(command.command[1]) == "ACK" {
+			// REPLCONF ACK <offset> [FACK <aofoffset>], never replied to as reply would go into replication stream
 			log.Println("Got ACK from slave")
 
-			masterchannel <- command.raw
+			offset, err := strconv.ParseInt(command.command[2], 10, 64)
+			if err == nil && s.link != nil {
+				offset, ok := s.offsets.ack(offset)
+				if ok {
+					s.link.ack(s, offset)
+				}
+			}
+		} else if len(command.command) >= 2 && name == "REPLCONF" && strings.ToUpper(command.command[1]) == "GETACK" {
+			// only master asks for ACK, ignored without reply
+		} else if len(command.command) >= 2 && name == "REPLCONF" {
+			// REPLCONF listening-port, REPLCONF capa, ...
+			for i := 1; i < len(command.command)-1; i++ {
+				if strings.ToLower(command.command[i]) == "capa" {
+					switch strings.ToLower(command.command[i+1]) {
+					case "eof":
+						s.capaEOF = true
+					case "psync2":
+						s.capaPSYNC2 = true
+					}
+				}
+			}
+
+			s.send([]byte("+OK\r\n"))
+			s.send(nil)
+		} else if reply, ok := adminCommand(command.command); ok {
+			s.send(reply)
+			s.send(nil)
 		} else {
 			// unknown command
-			slavechannel <- []byte("+ERR unknown command\r\n")
-			slavechannel <- nil
+			s.send(encodeError(fmt.Sprintf("ERR unknown command '%s'", command.command[0])))
+			s.send(nil)
 		}
 	}
 }
 
+// Accept slave connections for the shard
+func listenShard(sh *shard) {
+	ln, err := listen(sh.addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v\n", err)
+	}
+
+	log.Printf("Waiting for connection from slave at %s\n", sh.addr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Unable to accept: %v\n", err)
+			continue
+		}
+
+		if !clientAllowed(conn.RemoteAddr()) {
+			log.Printf("Rejected connection from %s: not in allowlist\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		go slaveReader(conn, sh)
+	}
+}
+
 func main() {
 	flag.StringVar(&masterHost, "master-host", "localhost", "Master Redis host")
 	flag.IntVar(&masterPort, "master-port", 6379, "Master Redis port")
+	sentinels := flag.String("sentinel", "", "Sentinel addresses to discover master, e.g. 10.0.0.1:26379,10.0.0.2:26379")
+	flag.StringVar(&sentinelMasterName, "master-name", "", "Name of master monitored by sentinels")
+	flag.StringVar(&masterUser, "master-user", "", "User name for authentication to master (Redis 6+ ACL)")
+	flag.StringVar(&masterPassword, "master-password", "", "Password for authentication to master")
+	passwordFile := flag.String("master-password-file", "", "File with password for authentication to master")
 	flag.StringVar(&proxyHost, "proxy-host", "", "Proxy listening interface, default is on all interfaces")
 	flag.IntVar(&proxyPort, "proxy-port", 6380, "Proxy port for listening")
+	flag.StringVar(&proxyUser, "proxy-user", "", "User name slaves should authenticate with (masteruser), default is \"default\"")
+	flag.StringVar(&proxyPassword, "proxy-password", "", "Password slaves should authenticate with (masterauth)")
+	masterTLS := flag.Bool("master-tls", false, "Use TLS for connection to master")
+	masterTLSCA := flag.String("master-tls-ca-cert", "", "CA certificate to verify master certificate, default is system CAs")
+	masterTLSCert := flag.String("master-tls-cert", "", "Client certificate for TLS connection to master")
+	masterTLSKey := flag.String("master-tls-key", "", "Client private key for TLS connection to master")
+	masterTLSServerName := flag.String("master-tls-server-name", "", "Server name for SNI and verification of master certificate, default is master host")
+	masterTLSSkipVerify := flag.Bool("master-tls-skip-verify", false, "Don't verify master certificate")
+	tlsCert := flag.String("tls-cert", "", "Certificate for TLS listener, enables TLS for slaves")
+	tlsKey := flag.String("tls-key", "", "Private key for TLS listener")
+	tlsCA := flag.String("tls-ca-cert", "", "CA certificate to verify slave client certificates, enables client authentication")
+	allow := flag.String("allow", "", "Accept slaves only from IP addresses and networks, e.g. 10.0.0.0/8,192.168.1.10")
+	flag.StringVar(&spoolDir, "spool-dir", "", "Directory for temporary files with filtered RDB, default is system temporary directory")
+	slots := flag.String("slots", "", "Pass only keys from hash slots (Redis Cluster compatible), e.g. 0-8191,10000")
+	flag.Var(&shards, "shard", "Shard as \"[host:]port condition...\", condition is regular expression, slots=<ranges> or db=<list>, could be repeated")
+	flag.DurationVar(&syncDelay, "sync-delay", 5*time.Second, "Time to wait for slaves of other shards before starting full resynchronization")
+	flag.StringVar(&keyPrefixStrip, "key-prefix-strip", "", "Remove prefix from keys on slaves")
+	flag.StringVar(&keyPrefixAdd, "key-prefix-add", "", "Add prefix to keys on slaves (after -key-prefix-strip)")
+	flag.DurationVar(&reconnectDelay, "reconnect-delay", time.Second, "Initial delay before reconnecting to master, doubled after each failed attempt")
+	flag.DurationVar(&reconnectMaxDelay, "reconnect-max-delay", 30*time.Second, "Maximum delay before reconnecting to master")
+	databases := flag.String("db-map", "", "Rewrite database numbers on slaves, e.g. 0:3,1:4")
+	flag.DurationVar(&rdbProgressInterval, "rdb-progress-interval", 10*time.Second, "How often to report progress of RDB transfer")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics at /metrics over HTTP, e.g. :9121, disabled by default")
+	policy := flag.String("command-policy", "", "Override classification of commands as keyed, broadcast or drop, e.g. FLUSHALL=drop,PUBLISH=drop")
 	flag.Parse()
 
-	if flag.NArg() != 1 {
-		flag.Usage()
-		fmt.Fprintln(os.Stderr, "Please specify regular expression to match against the Redis keys as the only argument.")
-		os.Exit(1)
+	if *sentinels != "" {
+		if sentinelMasterName == "" {
+			flag.Usage()
+			fmt.Fprintln(os.Stderr, "Master name should be specified with -master-name when using -sentinel.")
+			os.Exit(1)
+		}
+		sentinelAddrs = strings.Split(*sentinels, ",")
 	}
 
-	var err error
-	keyRegexp, err = regexp.Compile(flag.Arg(0))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Wrong format of regular expression: %v", err)
+	if *masterTLS {
+		var err error
+		masterTLSConfig, err = newMasterTLSConfig(*masterTLSCA, *masterTLSCert, *masterTLSKey, *masterTLSServerName, *masterTLSSkipVerify)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to configure TLS for master: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *tlsCert != "" {
+		var err error
+		proxyTLSConfig, err = newProxyTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to configure TLS listener: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *allow != "" {
+		var err error
+		allowedNets, err = parseAllowlist(*allow)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Wrong allowlist: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *passwordFile != "" {
+		password, err := ioutil.ReadFile(*passwordFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read password file: %v\n", err)
+			os.Exit(1)
+		}
+		masterPassword = strings.TrimSpace(string(password))
+	}
+
+	if masterUser != "" && masterPassword == "" {
+		flag.Usage()
+		fmt.Fprintln(os.Stderr, "Password should be specified with -master-user.")
 		os.Exit(1)
 	}
 
-	log.Printf("Redis Resharding Proxy configured for Redis master at %s:%d\n", masterHost, masterPort)
-	log.Printf("Waiting for connection from slave at %s:%d\n", proxyHost, proxyPort)
+	if *policy != "" {
+		var err error
+		commandPolicy, err = parseCommandPolicy(*policy)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Wrong command policy: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	// listen for incoming connection from Redis slave
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", proxyHost, proxyPort))
-	if err != nil {
-		log.Fatalf("Unable to listen: %v\n", err)
+	if *databases != "" {
+		var err error
+		dbMap, err = parseDBMap(*databases)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Wrong database map: %v\n", err)
+			os.Exit(1)
+		}
 	}
-	for {
-		conn, err := ln.Accept()
+
+	if len(shards) == 0 {
+		if flag.NArg() > 1 || flag.NArg() == 0 && *slots == "" {
+			flag.Usage()
+			fmt.Fprintln(os.Stderr, "Please specify regular expression to match against the Redis keys as the only argument, or hash slots with -slots.")
+			os.Exit(1)
+		}
+
+		conditions := flag.Args()
+		if *slots != "" {
+			conditions = append(conditions, "slots="+*slots)
+		}
+
+		rule, err := parseFilterRule(conditions)
 		if err != nil {
-			log.Printf("Unable to accept: %v\n", err)
-			continue
+			fmt.Fprintf(os.Stderr, "Wrong filter: %v\n", err)
+			os.Exit(1)
 		}
 
-		go slaveReader(conn)
+		shards = shardList{&shard{addr: strconv.Itoa(proxyPort), rules: []*filterRule{rule}}}
+	} else if flag.NArg() > 0 || *slots != "" {
+		flag.Usage()
+		fmt.Fprintln(os.Stderr, "Regular expression and -slots can't be used together with -shard.")
+		os.Exit(1)
+	}
+
+	for _, sh := range shards {
+		if !strings.Contains(sh.addr, ":") {
+			sh.addr = net.JoinHostPort(proxyHost, sh.addr)
+		}
+	}
+
+	if len(sentinelAddrs) > 0 {
+		log.Printf("Redis Resharding Proxy configured for Redis master %s monitored by sentinels %s\n",
+			sentinelMasterName, strings.Join(sentinelAddrs, ","))
+		go watchSentinels()
+	} else {
+		log.Printf("Redis Resharding Proxy configured for Redis master at %s:%d\n", masterHost, masterPort)
+	}
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
+	// listen for incoming connections from Redis slaves
+	for _, sh := range shards[1:] {
+		go listenShard(sh)
 	}
+	listenShard(shards[0])
 }
@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -70,6 +72,30 @@ func TestReadRedisCommand(t *testing.T) {
 			expected:      redisCommand{},
 			expectedError: fmt.Errorf("Unable to parse command length: strconv.ParseInt: parsing \"x\": invalid syntax"),
 		},
+		{
+			description:   "10: Full resync reply",
+			input:         "+FULLRESYNC 8de1787ba490483314a4d30f1c628bc5025eb761 2\r\n",
+			expected:      redisCommand{reply: "FULLRESYNC 8de1787ba490483314a4d30f1c628bc5025eb761 2"},
+			expectedError: nil,
+		},
+		{
+			description:   "11: PSYNC command",
+			input:         "*3\r\n$5\r\nPSYNC\r\n$40\r\n8de1787ba490483314a4d30f1c628bc5025eb761\r\n$4\r\n1234\r\n",
+			expected:      redisCommand{command: []string{"PSYNC", "8de1787ba490483314a4d30f1c628bc5025eb761", "1234"}},
+			expectedError: nil,
+		},
+		{
+			description:   "12: Diskless bulk reply",
+			input:         "$EOF:8de1787ba490483314a4d30f1c628bc5025eb761\r\n",
+			expected:      redisCommand{eofMark: []byte("8de1787ba490483314a4d30f1c628bc5025eb761")},
+			expectedError: nil,
+		},
+		{
+			description:   "13: Error reply",
+			input:         "-ERR unknown command 'PSYNC'\r\n",
+			expected:      redisCommand{errorReply: "ERR unknown command 'PSYNC'"},
+			expectedError: nil,
+		},
 	}
 
 	for _, test := range tests {
@@ -85,3 +111,63 @@ func TestReadRedisCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestEncodeRedisCommand(t *testing.T) {
+	encoded := string(encodeRedisCommand([]string{"REPLCONF", "ACK", "1234"}))
+	if encoded != "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$4\r\n1234\r\n" {
+		t.Errorf("encoded command doesn't match: %#v", encoded)
+	}
+}
+
+func TestSpoolRDB(t *testing.T) {
+	s := &slave{channel: make(chan []byte, 100), done: make(chan bool)}
+
+	rdbchannel, errchannel := startRDBFilter(func(ch chan<- []byte) error {
+		return FilterRDB(bufio.NewReader(bytes.NewBufferString(RDBFile1)), ch, func(key string) bool { return strings.HasPrefix(key, "a_") }, int64(len(RDBFile1)), nil)
+	})
+
+	spoolErr := s.spoolRDB(rdbchannel)
+	err := <-errchannel
+	close(s.channel)
+
+	received := ""
+
+	for data := range s.channel {
+		received += string(data)
+	}
+
+	if err != nil || spoolErr != nil {
+		t.Fatalf("Unable to spool RDB: %v, %v", err, spoolErr)
+	}
+
+	expected := "$37\r\nREDIS0006\xfe\x00\x00\x03a_1\x04lala\x00\x03a_2\xc0!\xff\xad}0`\xa6\xf4\xa1\xab"
+	if received != expected {
+		t.Errorf("output not equal to expected: %#v != %#v", expected, received)
+	}
+}
+
+func TestSlaveEmptyCommand(t *testing.T) {
+	for _, password := range []string{"", "secret"} {
+		proxyPassword = password
+
+		client, server := net.Pipe()
+		go slaveReader(server, &shard{addr: "empty"})
+		reader := bufio.NewReader(client)
+
+		client.Write([]byte("*0\r\n"))
+		client.Write(encodeRedisCommand([]string{"AUTH", "secret"}))
+		if password == "" {
+			expectData(t, reader, "-ERR AUTH called without any password configured\r\n")
+		} else {
+			expectData(t, reader, "+OK\r\n")
+		}
+
+		client.Write([]byte("*0\r\n"))
+		client.Write(encodeRedisCommand([]string{"PING"}))
+		expectData(t, reader, "+PONG\r\n")
+
+		client.Close()
+	}
+
+	proxyPassword = ""
+}
@@ -0,0 +1,883 @@
+package main
+
+// Replication link to master shared by several slaves
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ackInterval = time.Second
+
+// masterLink is a connection to master: proxy acts as a slave of master, received
+// replication stream is filtered for each slave attached to the link
+type masterLink struct {
+	sync.Mutex
+	id            int64
+	slaves        []*slave
+	acks          map[*slave]int64
+	replID        string
+	offset        int64
+	syncOffset    int64
+	psync         bool
+	db            int
+	transaction   []*redisCommand
+	streaming     bool
+	acking        bool
+	state         string
+	rdbProgress   *RDBProgress
+	addr          string
+	conn          net.Conn
+	masterchannel chan []byte
+	ready         chan bool
+	closed        bool
+}
+
+var (
+	// link which is waiting for slaves to join before starting full resynchronization
+	pendingLink *masterLink
+	pendingLock sync.Mutex
+
+	// links which are currently running
+	activeLinks = make(map[*masterLink]bool)
+	activeLock  sync.Mutex
+
+	// ID of the last link created
+	lastLinkID int64
+)
+
+func newMasterLink(replID string, offset int64) *masterLink {
+	return &masterLink{
+		id:            atomic.AddInt64(&lastLinkID, 1),
+		acks:          make(map[*slave]int64),
+		state:         "connecting",
+		replID:        replID,
+		offset:        offset,
+		syncOffset:    offset,
+		masterchannel: make(chan []byte, channelBuffer),
+		ready:         make(chan bool),
+	}
+}
+
+// Request full resynchronization for slave: slave joins pending link, so that
+// several slaves connecting at the same time share single RDB transfer
+func syncSlave(s *slave) {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+
+	s.offsets = &offsetMap{}
+	s.shard.setOffsets(s.offsets)
+
+	if pendingLink == nil || pendingLink.isClosed() {
+		pendingLink = newMasterLink("?", -1)
+		go pendingLink.run()
+		go pendingLink.wait(syncDelay)
+	}
+
+	pendingLink.attach(s)
+
+	if pendingLink.coversAllShards() {
+		close(pendingLink.ready)
+		pendingLink = nil
+	}
+}
+
+// Request partial resynchronization for slave, if slave offset can't be translated, full
+// resynchronization is requested instead
+func psyncSlave(s *slave, replID string, offset int64) {
+	last := s.shard.lastOffsets()
+	if last != nil {
+		// previous slave of the shard might be still replicating, so it keeps its own map
+		offsets := last.clone()
+		masterOffset, ok := offsets.psync(replID, offset)
+		if ok {
+			log.Printf("Requesting partial resynchronization from master at offset %d\n", masterOffset)
+
+			s.offsets = offsets
+			s.shard.setOffsets(offsets)
+
+			// link keeps offset of the last byte processed, master is asked for the next one
+			link := newMasterLink(replID, masterOffset-1)
+			link.db = offsets.currentDB()
+			link.attach(s)
+			close(link.ready)
+			go link.run()
+			return
+		}
+	}
+
+	syncSlave(s)
+}
+
+// Wait for other slaves to join for delay, then start the link
+func (link *masterLink) wait(delay time.Duration) {
+	select {
+	case <-link.ready:
+	case <-time.After(delay):
+		pendingLock.Lock()
+		if pendingLink == link {
+			close(link.ready)
+			pendingLink = nil
+		}
+		pendingLock.Unlock()
+	}
+}
+
+// Add slave to the link
+func (link *masterLink) attach(s *slave) {
+	link.Lock()
+	defer link.Unlock()
+
+	s.link = link
+	link.slaves = append(link.slaves, s)
+}
+
+// Remove slave from the link, link is closed when last slave is gone
+func (link *masterLink) detach(s *slave) {
+	link.Lock()
+	defer link.Unlock()
+
+	for i := range link.slaves {
+		if link.slaves[i] == s {
+			link.slaves = append(link.slaves[:i], link.slaves[i+1:]...)
+			break
+		}
+	}
+	delete(link.acks, s)
+
+	if len(link.slaves) == 0 {
+		link.closeLocked()
+	}
+}
+
+// Get current list of slaves
+func (link *masterLink) currentSlaves() []*slave {
+	link.Lock()
+	defer link.Unlock()
+
+	return append([]*slave(nil), link.slaves...)
+}
+
+// Check whether slaves from all shards are attached
+func (link *masterLink) coversAllShards() bool {
+	link.Lock()
+	defer link.Unlock()
+
+	covered := make(map[*shard]bool)
+	for _, s := range link.slaves {
+		covered[s.shard] = true
+	}
+
+	return len(covered) == len(shards)
+}
+
+// Send data to master, data is dropped if writer to master is stalled, so that
+// link lock is never held while blocked
+func (link *masterLink) send(data []byte) {
+	link.Lock()
+	defer link.Unlock()
+
+	if link.closed {
+		return
+	}
+
+	select {
+	case link.masterchannel <- data:
+	default:
+		log.Println("Connection to master is stalled, dropping command")
+	}
+}
+
+// Set state of the link (connecting, sync, streaming or reconnecting), used in metrics
+func (link *masterLink) setState(state string) {
+	link.Lock()
+	defer link.Unlock()
+
+	link.state = state
+}
+
+// Check whether link has been closed
+func (link *masterLink) isClosed() bool {
+	link.Lock()
+	defer link.Unlock()
+
+	return link.closed
+}
+
+// Stop sending data to master, should be called with lock held
+func (link *masterLink) closeLocked() {
+	if !link.closed {
+		link.closed = true
+		close(link.masterchannel)
+	}
+}
+
+// Slave acknowledged processing of replication stream up to master offset
+func (link *masterLink) ack(s *slave, offset int64) {
+	link.Lock()
+	defer link.Unlock()
+
+	link.acks[s] = offset
+}
+
+// Offset to acknowledge to master: minimal offset acknowledged by slaves, until
+// any slave acknowledges, offset replication has been started from
+func (link *masterLink) ackOffset() int64 {
+	link.Lock()
+	defer link.Unlock()
+
+	if len(link.acks) == 0 {
+		return link.syncOffset
+	}
+
+	result := int64(-1)
+	for _, offset := range link.acks {
+		if result == -1 || offset < result {
+			result = offset
+		}
+	}
+
+	return result
+}
+
+// Goroutine that periodically acknowledges replication offset to master
+func (link *masterLink) acker() {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+
+	for _ = range ticker.C {
+		if link.isClosed() {
+			return
+		}
+
+		link.send(encodeRedisCommand([]string{"REPLCONF", "ACK", strconv.FormatInt(link.ackOffset(), 10)}))
+	}
+}
+
+// Advance master offset after processing command
+func (link *masterLink) advance(n int64) {
+	link.Lock()
+	defer link.Unlock()
+
+	link.offset += n
+}
+
+// Read reply from master, skipping newlines
+func readReply(reader *bufio.Reader) (*redisCommand, error) {
+	for {
+		reply, err := readRedisCommand(reader)
+		if err != nil {
+			return nil, err
+		}
+
+		if reply.reply != "" || reply.errorReply != "" {
+			return reply, nil
+		}
+
+		if reply.command != nil {
+			return nil, fmt.Errorf("Unexpected command from master: %v", reply.command)
+		}
+	}
+}
+
+// Connect to master, request replication and filter it for all the slaves. When connection to master
+// is broken after replication has started, proxy reconnects with exponential backoff and continues
+// replication with PSYNC, keeping slaves connected
+func (link *masterLink) run() {
+	<-link.ready
+
+	activeLock.Lock()
+	activeLinks[link] = true
+	activeLock.Unlock()
+
+	defer func() {
+		activeLock.Lock()
+		delete(activeLinks, link)
+		activeLock.Unlock()
+	}()
+
+	defer link.disconnectSlaves()
+
+	defer func() {
+		link.Lock()
+		link.closeLocked()
+		link.Unlock()
+	}()
+
+	delay := reconnectDelay
+
+	for len(link.currentSlaves()) > 0 {
+		connected, err := link.replicate()
+		if err != nil {
+			log.Printf("Replication from master interrupted: %v\n", err)
+		}
+
+		if !link.streaming || !link.psync || link.isClosed() {
+			return
+		}
+
+		if connected {
+			delay = reconnectDelay
+		}
+
+		log.Printf("Reconnecting to master in %v\n", delay)
+		link.setState("reconnecting")
+		link.keepSlavesAlive(delay)
+		link.setState("connecting")
+		masterReconnects.add(1)
+
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
+		}
+	}
+}
+
+// Connect to master, starting writer for new connection
+func (link *masterLink) connect() (net.Conn, error) {
+	conn, err := dialMaster()
+	if err != nil {
+		return nil, err
+	}
+
+	link.Lock()
+	defer link.Unlock()
+
+	if link.closed {
+		conn.Close()
+		return nil, fmt.Errorf("All slaves have disconnected")
+	}
+
+	// writer of previous connection (if any) stops when its channel is closed
+	close(link.masterchannel)
+	link.masterchannel = make(chan []byte, channelBuffer)
+	go masterWriter(conn, link.masterchannel)
+
+	link.conn = conn
+	link.addr = conn.RemoteAddr().String()
+	return conn, nil
+}
+
+// Break connection to master, so that link reconnects (e.g. to new master after failover)
+func (link *masterLink) dropConnection() {
+	link.Lock()
+	conn := link.conn
+	link.Unlock()
+
+	// closing TLS connection might block on stalled write, so lock isn't held
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Reconnect all running links to master
+func reconnectLinks() {
+	activeLock.Lock()
+	links := make([]*masterLink, 0, len(activeLinks))
+	for link := range activeLinks {
+		links = append(links, link)
+	}
+	activeLock.Unlock()
+
+	for _, link := range links {
+		link.dropConnection()
+	}
+}
+
+// Replicate from master until connection is broken, connected is true if replication has been started
+func (link *masterLink) replicate() (connected bool, err error) {
+	conn, err := link.connect()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, bufSize)
+
+	err = link.handshake(reader)
+	if err != nil {
+		return false, fmt.Errorf("Unable to start replication: %v", err)
+	}
+
+	if link.psync && !link.acking {
+		link.acking = true
+		go link.acker()
+	}
+
+	for {
+		command, err := readRedisCommand(reader)
+		if err != nil {
+			return true, err
+		}
+
+		if command.eofMark != nil || command.bulkSize > 0 {
+			// RDB transfer
+			err = link.transferRDB(reader, command)
+			if err != nil {
+				return true, fmt.Errorf("Unable to read RDB: %v", err)
+			}
+
+			link.streaming = true
+			link.setState("streaming")
+			log.Println("RDB filtering finished, filtering commands...")
+		} else if command.command == nil && command.reply == "" && command.errorReply == "" {
+			// newline keepalive while master is preparing RDB, once streaming started newline
+			// is a part of replication stream and is counted in offsets
+			length := int64(len(command.raw))
+			if link.streaming {
+				link.advance(length)
+			}
+
+			for _, s := range link.currentSlaves() {
+				if link.streaming {
+					s.offsets.advance(length, length)
+				}
+				s.send(command.raw)
+				s.send(nil)
+			}
+		} else if command.command == nil {
+			log.Printf("Unexpected reply from master: %s%s\n", command.reply, command.errorReply)
+		} else if len(command.command) == 0 {
+			// empty command, nothing to filter
+			continue
+		} else {
+			link.filterCommand(command)
+		}
+	}
+}
+
+// Wait for delay while master is unavailable, sending newlines to slaves so that they don't time out
+func (link *masterLink) keepSlavesAlive(delay time.Duration) {
+	deadline := time.Now().Add(delay)
+
+	for !link.isClosed() {
+		for _, s := range link.currentSlaves() {
+			// slave counts newline in its replication offset
+			s.offsets.advance(0, 1)
+			s.send([]byte("\n"))
+			s.send(nil)
+		}
+
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return
+		}
+		if wait > keepaliveInterval {
+			wait = keepaliveInterval
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Authenticate to master with password (and ACL user, if configured)
+func (link *masterLink) authenticate(reader *bufio.Reader) error {
+	if masterPassword == "" {
+		return nil
+	}
+
+	if masterUser != "" {
+		link.send(encodeRedisCommand([]string{"AUTH", masterUser, masterPassword}))
+	} else {
+		link.send(encodeRedisCommand([]string{"AUTH", masterPassword}))
+	}
+
+	reply, err := readReply(reader)
+	if err != nil {
+		return err
+	}
+	if reply.errorReply != "" {
+		return fmt.Errorf("Authentication to master failed: %s", reply.errorReply)
+	}
+
+	return nil
+}
+
+// Check whether master rejected command as proxy isn't authenticated
+func authError(reply *redisCommand) error {
+	if strings.HasPrefix(reply.errorReply, "NOAUTH") {
+		return fmt.Errorf("Master requires authentication (see -master-password): %s", reply.errorReply)
+	}
+
+	return nil
+}
+
+// Introduce proxy to master as slave and request replication
+func (link *masterLink) handshake(reader *bufio.Reader) error {
+	err := link.authenticate(reader)
+	if err != nil {
+		return err
+	}
+
+	link.send(encodeRedisCommand([]string{"REPLCONF", "capa", "eof", "capa", "psync2"}))
+
+	reply, err := readReply(reader)
+	if err != nil {
+		return err
+	}
+	if err = authError(reply); err != nil {
+		return err
+	}
+	if reply.errorReply != "" {
+		log.Printf("Master doesn't support capabilities: %s\n", reply.errorReply)
+	}
+
+	offset := link.offset
+	if link.replID != "?" {
+		// request replication from the byte following the last processed one
+		offset++
+	}
+
+	link.send(encodeRedisCommand([]string{"PSYNC", link.replID, strconv.FormatInt(offset, 10)}))
+
+	reply, err = readReply(reader)
+	if err != nil {
+		return err
+	}
+	if err = authError(reply); err != nil {
+		return err
+	}
+
+	fields := strings.Fields(reply.reply)
+
+	if link.streaming && (len(fields) == 0 || fields[0] != "CONTINUE") {
+		// slaves are in the middle of replication stream, they can't receive new RDB
+		link.streaming = false
+		return fmt.Errorf("Master can't continue replication (%s%s), slaves need full resynchronization",
+			reply.reply, reply.errorReply)
+	}
+
+	if len(fields) == 3 && fields[0] == "FULLRESYNC" {
+		log.Printf("Master requested full resynchronization: %s\n", reply.reply)
+
+		offset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Unable to parse offset: %v", err)
+		}
+
+		link.fullResync(fields[1], offset)
+	} else if len(fields) >= 1 && fields[0] == "CONTINUE" {
+		log.Println("Partial resynchronization accepted, filtering commands...")
+
+		if len(fields) == 2 {
+			link.Lock()
+			link.replID = fields[1]
+			link.Unlock()
+		}
+
+		if !link.streaming {
+			link.streaming = true
+			link.continueResync()
+		}
+		link.setState("streaming")
+	} else if reply.errorReply != "" {
+		log.Printf("Master doesn't support PSYNC (%s), starting SYNC\n", reply.errorReply)
+
+		link.send([]byte("SYNC\r\n"))
+		link.fullResync("", 0)
+	} else {
+		return fmt.Errorf("Unexpected reply to PSYNC: %s", reply.reply)
+	}
+
+	return nil
+}
+
+// Master started full resynchronization, notify slaves
+func (link *masterLink) fullResync(replID string, offset int64) {
+	link.Lock()
+	link.replID = replID
+	link.offset = offset
+	link.syncOffset = offset
+	link.psync = replID != ""
+	link.state = "sync"
+	link.Unlock()
+
+	// RDB is loaded starting with database 0, master sends SELECT before first command
+	link.db = 0
+
+	if replID == "" {
+		// master doesn't support PSYNC, but slave might expect reply
+		replID = strings.Repeat("0", 40)
+	}
+
+	for _, s := range link.currentSlaves() {
+		s.offsets.reset(replID, offset)
+
+		if s.psync {
+			s.send([]byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", replID, offset)))
+			s.send(nil)
+		}
+	}
+}
+
+// Master accepted partial resynchronization, slave can continue replication
+func (link *masterLink) continueResync() {
+	link.Lock()
+	link.psync = true
+	link.Unlock()
+
+	for _, s := range link.currentSlaves() {
+		s.offsets.resume(link.replID)
+
+		if s.capaPSYNC2 {
+			s.send([]byte(fmt.Sprintf("+CONTINUE %s\r\n", link.replID)))
+		} else {
+			s.send([]byte("+CONTINUE\r\n"))
+		}
+		s.send(nil)
+	}
+}
+
+// Filter RDB once for all slaves, sending it to slaves in parallel
+func (link *masterLink) transferRDB(reader *bufio.Reader, command *redisCommand) error {
+	if command.eofMark != nil {
+		log.Println("RDB transfer with EOF mark")
+	} else {
+		log.Printf("RDB size: %d\n", command.bulkSize)
+	}
+
+	slaves := link.currentSlaves()
+	outputs := make([]*RDBOutput, len(slaves))
+	channels := make([]chan []byte, len(slaves))
+
+	var wg sync.WaitGroup
+
+	for i, s := range slaves {
+		channels[i] = make(chan []byte, channelBuffer)
+		outputs[i] = NewRDBOutput(channels[i], s.shard.match)
+		outputs[i].name = s.shard.addr
+		outputs[i].dbMap = dbMap
+		outputs[i].transform = keyTransform()
+
+		wg.Add(1)
+		go func(s *slave, rdbchannel <-chan []byte) {
+			defer wg.Done()
+
+			err := s.sendRDB(rdbchannel)
+			if err != nil {
+				log.Printf("Unable to send RDB to slave %s: %v\n", s.conn.RemoteAddr(), err)
+				s.conn.Close()
+			}
+		}(s, channels[i])
+	}
+
+	err := FilterRDBOutputs(reader, outputs, command.bulkSize, command.eofMark, link.reportRDBProgress)
+	if err != nil {
+		// make sure slaves don't receive incomplete RDB
+		for _, s := range slaves {
+			s.conn.Close()
+		}
+	}
+
+	for _, rdbchannel := range channels {
+		close(rdbchannel)
+	}
+
+	wg.Wait()
+	return err
+}
+
+// Report progress of RDB filtering to log and metrics, last progress is kept for status of the link
+func (link *masterLink) reportRDBProgress(progress RDBProgress) {
+	link.Lock()
+	link.rdbProgress = &progress
+	link.Unlock()
+
+	if progress.Finished {
+		log.Printf("RDB filtered: %s\n", progress)
+	} else {
+		log.Printf("RDB filtering progress: %s\n", progress)
+	}
+
+	if percent, ok := progress.Percent(); ok {
+		rdbProgressRatio.set(percent / 100)
+	}
+	if eta, ok := progress.ETA(); ok {
+		rdbETA.set(eta.Seconds())
+	}
+	rdbThroughput.set(progress.Throughput())
+}
+
+// Filter command from replication stream for each slave, commands between MULTI and EXEC
+// are buffered and filtered as one transaction
+func (link *masterLink) filterCommand(command *redisCommand) {
+	length := int64(len(command.raw))
+	link.advance(length)
+
+	name := strings.ToUpper(command.command[0])
+
+	if link.transaction != nil {
+		link.transaction = append(link.transaction, command)
+		if name == "EXEC" || name == "DISCARD" {
+			link.filterTransaction()
+			link.transaction = nil
+		}
+		return
+	}
+
+	if name == "MULTI" {
+		link.transaction = []*redisCommand{command}
+		return
+	}
+
+	link.trackDB(command)
+
+	conflicts := 0
+	transform := keyTransform()
+
+	for _, s := range link.currentSlaves() {
+		raw, conflict := filterCommandForSlave(s, command, link.db, transform)
+		if conflict {
+			conflicts++
+		}
+
+		if raw == nil {
+			s.offsets.advance(length, 0)
+			continue
+		}
+
+		s.offsets.advance(length, int64(len(raw)))
+		s.send(raw)
+		s.send(nil)
+	}
+
+	if conflicts > 0 {
+		commandConflicts.add(float64(conflicts), name)
+		log.Printf("Command %s touches keys of different shards and can't be split, passed unchanged to %d slave(s)\n",
+			name, conflicts)
+	}
+}
+
+// Track database selected with SELECT command
+func (link *masterLink) trackDB(command *redisCommand) {
+	if strings.ToUpper(command.command[0]) != "SELECT" || len(command.command) != 2 {
+		return
+	}
+
+	db, err := strconv.Atoi(command.command[1])
+	if err != nil {
+		log.Printf("Unable to parse database number in SELECT: %#v\n", command.command[1])
+		return
+	}
+
+	link.db = db
+	for _, s := range link.currentSlaves() {
+		s.offsets.selectDB(db)
+	}
+}
+
+// Filter buffered transaction (MULTI, commands, EXEC or DISCARD) for each slave: slave receives transaction
+// with commands which passed the filter, or nothing at all if none of them passed
+func (link *masterLink) filterTransaction() {
+	multi := link.transaction[0]
+	exec := link.transaction[len(link.transaction)-1]
+	commands := link.transaction[1 : len(link.transaction)-1]
+	discarded := strings.ToUpper(exec.command[0]) == "DISCARD"
+
+	var length int64
+	for _, command := range link.transaction {
+		length += int64(len(command.raw))
+	}
+
+	// database selected before each command
+	dbs := make([]int, len(commands))
+	for i, command := range commands {
+		dbs[i] = link.db
+		link.trackDB(command)
+	}
+
+	conflicts := 0
+	transform := keyTransform()
+
+	for _, s := range link.currentSlaves() {
+		var (
+			filtered [][]byte
+			selects  [][]byte
+			passed   bool
+		)
+
+		for i, command := range commands {
+			raw, conflict := filterCommandForSlave(s, command, dbs[i], transform)
+			if conflict {
+				conflicts++
+				commandConflicts.add(1, strings.ToUpper(command.command[0]))
+			}
+
+			if raw == nil {
+				continue
+			}
+
+			filtered = append(filtered, raw)
+			if strings.ToUpper(command.command[0]) == "SELECT" {
+				selects = append(selects, raw)
+			} else {
+				passed = true
+			}
+		}
+
+		if discarded || !passed {
+			// slave still needs to follow database changes
+			filtered = selects
+		} else {
+			filtered = append([][]byte{multi.raw}, append(filtered, exec.raw)...)
+		}
+
+		var sent int64
+		for _, raw := range filtered {
+			sent += int64(len(raw))
+		}
+
+		s.offsets.advance(length, sent)
+
+		if len(filtered) > 0 {
+			for _, raw := range filtered {
+				s.send(raw)
+			}
+			s.send(nil)
+		}
+	}
+
+	if conflicts > 0 {
+		log.Printf("Transaction touches keys of different shards and can't be split, %d command(s) passed unchanged\n",
+			conflicts)
+	}
+}
+
+// Filter command for slave: db is database selected when command is executed, returns data
+// to be sent to slave (nil if command is dropped) and true if command couldn't be split by keys
+func filterCommandForSlave(s *slave, command *redisCommand, db int, transform func(string) string) ([]byte, bool) {
+	sh := s.shard
+	match := func(key string) bool { return sh.match(db, key) }
+	name := strings.ToUpper(command.command[0])
+
+	result, rewritten, conflict := filterCommandKeys(command.command, match)
+	if result == nil {
+		commandsTotal.add(1, sh.addr, name, "dropped")
+		return nil, conflict
+	}
+
+	commandsTotal.add(1, sh.addr, name, "forwarded")
+
+	var remapped, renamed bool
+	result, remapped = remapCommandDB(result, dbMap)
+	result, renamed = transformCommandKeys(result, transform)
+
+	if rewritten || remapped || renamed {
+		return encodeRedisCommand(result), conflict
+	}
+
+	return command.raw, conflict
+}
+
+// Disconnect all remaining slaves, so that they start replication from scratch
+func (link *masterLink) disconnectSlaves() {
+	for _, s := range link.currentSlaves() {
+		s.conn.Close()
+	}
+}
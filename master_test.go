@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read command and compare it with expected one
+func expectCommand(t *testing.T, reader *bufio.Reader, expected ...string) bool {
+	command, err := readRedisCommand(reader)
+	if err != nil {
+		t.Errorf("Unable to read command: %v", err)
+		return false
+	}
+
+	if strings.Join(command.command, " ") != strings.Join(expected, " ") {
+		t.Errorf("Unexpected command: %#v != %#v", command.command, expected)
+		return false
+	}
+
+	return true
+}
+
+// Read exact data and compare it with expected one
+func expectData(t *testing.T, reader *bufio.Reader, expected string) []byte {
+	data := make([]byte, len(expected))
+	_, err := io.ReadFull(reader, data)
+	if err != nil {
+		t.Fatalf("Unable to read data: %v", err)
+	}
+
+	if !strings.HasSuffix(expected, "*") && string(data) != expected {
+		t.Fatalf("Unexpected data: %#v != %#v", string(data), expected)
+	}
+
+	return data
+}
+
+// Start fake Redis master listening on random port, master is configured as proxy upstream
+func startFakeMaster(t *testing.T, handler func(reader *bufio.Reader, conn net.Conn)) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+
+	masterHost = "127.0.0.1"
+	masterPort = ln.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		handler(bufio.NewReader(conn), conn)
+	}()
+
+	return ln
+}
+
+func TestMasterLinkFanOut(t *testing.T) {
+	const replID = "8de1787ba490483314a4d30f1c628bc5025eb761"
+
+	setA := string(encodeRedisCommand([]string{"SET", "a_1", "x"}))
+	setB := string(encodeRedisCommand([]string{"SET", "b_1", "y"}))
+	ping := string(encodeRedisCommand([]string{"PING"}))
+
+	masterAck := 100 + len(setA) + len(setB) + len(ping)
+	slaveAck := 100 + len(setA) + len(ping)
+	acked := make(chan bool)
+
+	ln := startFakeMaster(t, func(reader *bufio.Reader, conn net.Conn) {
+		if !expectCommand(t, reader, "REPLCONF", "capa", "eof", "capa", "psync2") {
+			return
+		}
+		conn.Write([]byte("+OK\r\n"))
+		if !expectCommand(t, reader, "PSYNC", "?", "-1") {
+			return
+		}
+		conn.Write([]byte(fmt.Sprintf("+FULLRESYNC %s 100\r\n\n$%d\r\n%s", replID, len(RDBFile1), RDBFile1)))
+		conn.Write([]byte(setA + setB + ping))
+
+		for {
+			command, err := readRedisCommand(reader)
+			if err != nil {
+				return
+			}
+			if len(command.command) == 3 && command.command[2] == strconv.Itoa(masterAck) {
+				close(acked)
+				return
+			}
+		}
+	})
+	defer ln.Close()
+
+	shardA := &shard{addr: "a"}
+	shardA.rules = []*filterRule{{regexp: regexp.MustCompile("^a_")}}
+	shardB := &shard{addr: "b"}
+	shardB.rules = []*filterRule{{regexp: regexp.MustCompile("^b_")}}
+	shards = shardList{shardA, shardB}
+	syncDelay = time.Minute
+	reconnectDelay, reconnectMaxDelay = time.Minute, time.Minute
+
+	clientA, serverA := net.Pipe()
+	defer clientA.Close()
+	go slaveReader(serverA, shardA)
+	readerA := bufio.NewReader(clientA)
+
+	clientB, serverB := net.Pipe()
+	defer clientB.Close()
+	go slaveReader(serverB, shardB)
+	readerB := bufio.NewReader(clientB)
+
+	// slave A supports EOF mark and PSYNC, slave B is old one
+	clientA.Write(encodeRedisCommand([]string{"REPLCONF", "capa", "eof"}))
+	expectData(t, readerA, "+OK\r\n")
+	clientA.Write(encodeRedisCommand([]string{"PSYNC", "?", "-1"}))
+	clientB.Write([]byte("SYNC\r\n"))
+
+	expectData(t, readerA, fmt.Sprintf("+FULLRESYNC %s 100\r\n", replID))
+	expectData(t, readerA, "\n")
+	expectData(t, readerB, "\n")
+
+	rdbA := filterRDBString(RDBFile1, func(key string) bool { return strings.HasPrefix(key, "a_") })
+	expectData(t, readerA, "$EOF:")
+	mark := expectData(t, readerA, strings.Repeat("*", eofMarkSize))
+	expectData(t, readerA, "\r\n"+rdbA+string(mark))
+	expectData(t, readerA, setA+ping)
+
+	rdbB := filterRDBString(RDBFile1, func(key string) bool { return strings.HasPrefix(key, "b_") })
+	expectData(t, readerB, fmt.Sprintf("$%d\r\n%s", len(rdbB), rdbB))
+	expectData(t, readerB, setB+ping)
+
+	clientA.Write(encodeRedisCommand([]string{"REPLCONF", "ACK", strconv.Itoa(slaveAck)}))
+
+	select {
+	case <-acked:
+	case <-time.After(5 * time.Second):
+		t.Errorf("master didn't receive translated ACK")
+	}
+}
+
+// Collect data sent to slave so far
+func sentToSlave(s *slave) string {
+	result := ""
+
+	for {
+		select {
+		case data := <-s.channel:
+			result += string(data)
+		default:
+			return result
+		}
+	}
+}
+
+func TestMasterLinkTransaction(t *testing.T) {
+	shardA := &shard{addr: "a", rules: []*filterRule{{regexp: regexp.MustCompile("^a_")}}}
+	shardB := &shard{addr: "b", rules: []*filterRule{{regexp: regexp.MustCompile("^b_")}}}
+
+	link := newMasterLink("?", -1)
+
+	slaveA := &slave{shard: shardA, offsets: &offsetMap{}, channel: make(chan []byte, channelBuffer)}
+	slaveB := &slave{shard: shardB, offsets: &offsetMap{}, channel: make(chan []byte, channelBuffer)}
+	for _, s := range []*slave{slaveA, slaveB} {
+		s.offsets.reset("x", 0)
+		link.attach(s)
+	}
+
+	commands := [][]string{
+		{"MULTI"}, {"SET", "a_1", "x"}, {"SELECT", "1"}, {"INCR", "a_2"}, {"EXEC"},
+		{"MULTI"}, {"DEL", "b_1", "a_1"}, {"EXEC"},
+		{"MULTI"}, {"SET", "a_3", "y"}, {"DISCARD"},
+	}
+
+	var length int64
+	for _, command := range commands {
+		raw := encodeRedisCommand(command)
+		length += int64(len(raw))
+		link.filterCommand(&redisCommand{raw: raw, command: command})
+	}
+
+	encode := func(commands ...[]string) string {
+		result := ""
+		for _, command := range commands {
+			result += string(encodeRedisCommand(command))
+		}
+		return result
+	}
+
+	expectedA := encode([]string{"MULTI"}, []string{"SET", "a_1", "x"}, []string{"SELECT", "1"}, []string{"INCR", "a_2"}, []string{"EXEC"},
+		[]string{"MULTI"}, []string{"DEL", "a_1"}, []string{"EXEC"})
+	expectedB := encode([]string{"SELECT", "1"}, []string{"MULTI"}, []string{"DEL", "b_1"}, []string{"EXEC"})
+
+	for _, test := range []struct {
+		s        *slave
+		expected string
+	}{{slaveA, expectedA}, {slaveB, expectedB}} {
+		sent := sentToSlave(test.s)
+		if sent != test.expected {
+			t.Errorf("slave %s received %#v != %#v", test.s.shard.addr, sent, test.expected)
+		}
+
+		if test.s.offsets.master != length || test.s.offsets.slave != int64(len(test.expected)) {
+			t.Errorf("slave %s offsets %d, %d != %d, %d", test.s.shard.addr, test.s.offsets.master, test.s.offsets.slave,
+				length, len(test.expected))
+		}
+	}
+
+	if link.db != 1 || slaveB.offsets.currentDB() != 1 {
+		t.Errorf("database not tracked: %d", link.db)
+	}
+}
+
+func TestMasterLinkSendStalled(t *testing.T) {
+	link := newMasterLink("?", -1)
+
+	done := make(chan bool)
+	go func() {
+		// nobody writes to master, queue fills up
+		for i := 0; i < channelBuffer+10; i++ {
+			link.send([]byte("PING\r\n"))
+		}
+		link.currentSlaves()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("send blocked on stalled connection to master")
+	}
+
+	if len(link.masterchannel) != channelBuffer {
+		t.Errorf("queue to master should be full: %d", len(link.masterchannel))
+	}
+}
+
+func TestMasterLinkAckOffset(t *testing.T) {
+	link := newMasterLink("?", -1)
+	link.fullResync("8de1787ba490483314a4d30f1c628bc5025eb761", 100)
+	link.advance(50)
+
+	// slaves haven't loaded RDB yet
+	if link.ackOffset() != 100 {
+		t.Errorf("ackOffset() = %d != 100", link.ackOffset())
+	}
+
+	slaveA, slaveB := &slave{}, &slave{}
+	link.ack(slaveA, 140)
+	link.ack(slaveB, 120)
+
+	if link.ackOffset() != 120 {
+		t.Errorf("ackOffset() = %d != 120", link.ackOffset())
+	}
+
+	// partial resynchronization starts from offset requested by slave
+	link = newMasterLink("8de1787ba490483314a4d30f1c628bc5025eb761", 200)
+	link.advance(10)
+
+	if link.ackOffset() != 200 {
+		t.Errorf("ackOffset() = %d != 200", link.ackOffset())
+	}
+}
+
+func TestMasterLinkAuthenticate(t *testing.T) {
+	defer func() { masterUser, masterPassword = "", "" }()
+
+	tests := []struct {
+		user, password string
+		expected       []string
+		reply          string
+		ok             bool
+	}{
+		{"", "secret", []string{"AUTH", "secret"}, "+OK\r\n", true},
+		{"proxy", "secret", []string{"AUTH", "proxy", "secret"}, "+OK\r\n", true},
+		{"proxy", "wrong", []string{"AUTH", "proxy", "wrong"}, "-WRONGPASS invalid username-password pair\r\n", false},
+		{"", "", []string{"REPLCONF", "capa", "eof", "capa", "psync2"}, "-NOAUTH Authentication required.\r\n", false},
+	}
+
+	for _, test := range tests {
+		masterUser, masterPassword = test.user, test.password
+
+		client, server := net.Pipe()
+		link := newMasterLink("?", -1)
+		go masterWriter(client, link.masterchannel)
+
+		go func() {
+			if expectCommand(t, bufio.NewReader(server), test.expected...) {
+				server.Write([]byte(test.reply))
+			}
+		}()
+
+		var err error
+		if test.password != "" {
+			err = link.authenticate(bufio.NewReader(client))
+		} else {
+			err = link.handshake(bufio.NewReader(client))
+		}
+
+		if test.ok && err != nil {
+			t.Errorf("unexpected error: %v", err)
+		} else if !test.ok && (err == nil || !strings.Contains(err.Error(), "uthentication")) {
+			t.Errorf("expected authentication error, got %v", err)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestMasterLinkReconnect(t *testing.T) {
+	const replID = "8de1787ba490483314a4d30f1c628bc5025eb761"
+
+	setA1 := string(encodeRedisCommand([]string{"SET", "a_1", "x"}))
+	setB1 := string(encodeRedisCommand([]string{"SET", "b_1", "y"}))
+	setA2 := string(encodeRedisCommand([]string{"SET", "a_2", "z"}))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer ln.Close()
+
+	masterHost = "127.0.0.1"
+	masterPort = ln.Addr().(*net.TCPAddr).Port
+	reconnectDelay, reconnectMaxDelay = 10*time.Millisecond, 20*time.Millisecond
+
+	go func() {
+		// first connection: full resynchronization, then connection is dropped
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		reader := bufio.NewReader(conn)
+		if expectCommand(t, reader, "REPLCONF", "capa", "eof", "capa", "psync2") {
+			conn.Write([]byte("+OK\r\n"))
+			if expectCommand(t, reader, "PSYNC", "?", "-1") {
+				conn.Write([]byte(fmt.Sprintf("+FULLRESYNC %s 100\r\n$%d\r\n%s", replID, len(RDBFile1), RDBFile1)))
+				conn.Write([]byte(setA1 + setB1))
+			}
+		}
+		conn.Close()
+
+		// second connection: replication continues from the last offset
+		conn, err = ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader = bufio.NewReader(conn)
+		if expectCommand(t, reader, "REPLCONF", "capa", "eof", "capa", "psync2") {
+			conn.Write([]byte("+OK\r\n"))
+			if expectCommand(t, reader, "PSYNC", replID, strconv.Itoa(100+len(setA1)+len(setB1)+1)) {
+				// newline in replication stream is counted in offsets
+				conn.Write([]byte("+CONTINUE\r\n\n" + setA2))
+			}
+		}
+		io.Copy(ioutil.Discard, reader)
+	}()
+
+	shardA := &shard{addr: "a", rules: []*filterRule{{regexp: regexp.MustCompile("^a_")}}}
+	shards = shardList{shardA}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go slaveReader(server, shardA)
+	reader := bufio.NewReader(client)
+
+	client.Write(encodeRedisCommand([]string{"REPLCONF", "capa", "eof"}))
+	expectData(t, reader, "+OK\r\n")
+	client.Write(encodeRedisCommand([]string{"PSYNC", "?", "-1"}))
+
+	expectData(t, reader, fmt.Sprintf("+FULLRESYNC %s 100\r\n", replID))
+	expectData(t, reader, "$EOF:")
+	mark := expectData(t, reader, strings.Repeat("*", eofMarkSize))
+	rdbA := filterRDBString(RDBFile1, func(key string) bool { return strings.HasPrefix(key, "a_") })
+	expectData(t, reader, "\r\n"+rdbA+string(mark))
+	expectData(t, reader, setA1)
+
+	// newlines keep slave alive while proxy reconnects
+	newlines := 0
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			t.Fatalf("Unable to read: %v", err)
+		}
+		if b != '\n' {
+			reader.UnreadByte()
+			break
+		}
+		newlines++
+	}
+	if newlines == 0 {
+		t.Errorf("expected newlines while reconnecting")
+	}
+
+	expectData(t, reader, setA2)
+
+	offsets := shardA.lastOffsets()
+	masterOffset, ok := offsets.toMaster(100 + int64(len(setA1)+newlines+len(setA2)))
+	if !ok || masterOffset != 100+int64(len(setA1)+len(setB1)+1+len(setA2)) {
+		t.Errorf("offset not translated correctly: %d, %v", masterOffset, ok)
+	}
+
+	// ACK with AOF offset (Redis 7.2+) is translated, neither ACK nor GETACK is replied to
+	slaveOffset := 100 + len(setA1) + newlines + len(setA2)
+	client.Write(encodeRedisCommand([]string{"REPLCONF", "ACK", strconv.Itoa(slaveOffset), "FACK", "42"}))
+	client.Write(encodeRedisCommand([]string{"REPLCONF", "GETACK", "*"}))
+	client.Write(encodeRedisCommand([]string{"PING"}))
+	expectData(t, reader, "+PONG\r\n")
+
+	acked := false
+	for _, link := range currentLinks() {
+		for _, s := range link.currentSlaves() {
+			if s.shard == shardA {
+				acked = link.ackOffset() == masterOffset
+			}
+		}
+	}
+	if !acked {
+		t.Errorf("ACK from slave not translated to %d", masterOffset)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+// Metrics exposed over HTTP in Prometheus text format
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const metricsPrefix = "redis_resharding_proxy_"
+
+// metric is a counter or gauge, value is kept for each combination of label values
+type metric struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]*metricValue
+}
+
+// metricValue is a value of metric for some combination of label values
+type metricValue struct {
+	labels []string
+	value  float64
+}
+
+// all registered metrics, in order of registration
+var metrics []*metric
+
+var (
+	rdbReadBytes     = newMetric("counter", "rdb_read_bytes_total", "Bytes of RDB read from master")
+	rdbWrittenBytes  = newMetric("counter", "rdb_written_bytes_total", "Bytes of filtered RDB sent to slaves", "shard")
+	rdbKeys          = newMetric("counter", "rdb_keys_total", "Keys in RDB kept or dropped by filter", "shard", "type", "action")
+	commandsTotal    = newMetric("counter", "commands_total", "Commands from master forwarded to or dropped for slaves", "shard", "command", "action")
+	commandConflicts = newMetric("counter", "command_conflicts_total", "Commands which touch keys of different shards and can't be split", "command")
+	masterReconnects = newMetric("counter", "master_reconnects_total", "Reconnections to master after replication has started")
+	slavesConnected  = newMetric("gauge", "slaves_connected", "Slaves connected to proxy", "shard")
+	rdbProgressRatio = newMetric("gauge", "rdb_progress_ratio", "Part of RDB read from master during last transfer")
+	rdbETA           = newMetric("gauge", "rdb_eta_seconds", "Estimated time to finish reading RDB from master")
+	rdbThroughput    = newMetric("gauge", "rdb_throughput_bytes", "Average speed of reading RDB from master, bytes per second")
+
+	// gauges below are collected from running links when metrics are requested
+	masterLinks       = newMetric("gauge", "master_links", "Replication links to master by state", "state")
+	masterQueueLength = newMetric("gauge", "master_queue_length", "Commands waiting to be sent to master")
+	slaveQueueLength  = newMetric("gauge", "slave_queue_length", "Chunks of data waiting to be sent to slave", "shard", "slave")
+	slaveAckOffset    = newMetric("gauge", "slave_ack_offset", "Master replication offset acknowledged by slave", "shard", "slave")
+	masterReplOffset  = newMetric("gauge", "master_repl_offset", "Replication offset of master processed by proxy")
+
+	collectedMetrics = []*metric{masterLinks, masterQueueLength, slaveQueueLength, slaveAckOffset, masterReplOffset}
+	masterLinkStates = []string{"connecting", "sync", "streaming", "reconnecting"}
+
+	// collected gauges are updated by one request at a time
+	collectLock sync.Mutex
+)
+
+// Create metric and register it for export
+func newMetric(kind, name, help string, labels ...string) *metric {
+	m := &metric{
+		name:   metricsPrefix + name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*metricValue),
+	}
+
+	metrics = append(metrics, m)
+	return m
+}
+
+// Get value for label values, should be called with lock held
+func (m *metric) valueLocked(labelValues []string) *metricValue {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\x00")
+	value := m.values[key]
+	if value == nil {
+		value = &metricValue{labels: append([]string(nil), labelValues...)}
+		m.values[key] = value
+	}
+
+	return value
+}
+
+// Add delta to metric value
+func (m *metric) add(delta float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.valueLocked(labelValues).value += delta
+}
+
+// Set metric value
+func (m *metric) set(value float64, labelValues ...string) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.valueLocked(labelValues).value = value
+}
+
+// Get metric value, zero if it has never been set
+func (m *metric) get(labelValues ...string) float64 {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.valueLocked(labelValues).value
+}
+
+// Forget all values of the metric
+func (m *metric) reset() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.values = make(map[string]*metricValue)
+}
+
+// Escape label value for text format
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Write metric in Prometheus text format, values are sorted by labels
+func (m *metric) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.values))
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := m.values[key]
+
+		labels := make([]string, len(m.labels))
+		for i, label := range m.labels {
+			labels[i] = fmt.Sprintf("%s=\"%s\"", label, escapeLabelValue(value.labels[i]))
+		}
+
+		if len(labels) > 0 {
+			fmt.Fprintf(w, "%s{%s} %s\n", m.name, strings.Join(labels, ","), strconv.FormatFloat(value.value, 'g', -1, 64))
+		} else {
+			fmt.Fprintf(w, "%s %s\n", m.name, strconv.FormatFloat(value.value, 'g', -1, 64))
+		}
+	}
+}
+
+// Update gauges which reflect current state of replication links
+func collectMetrics() {
+	for _, m := range collectedMetrics {
+		m.reset()
+	}
+
+	for _, state := range masterLinkStates {
+		masterLinks.set(0, state)
+	}
+	masterQueueLength.set(0)
+
+	activeLock.Lock()
+	links := make([]*masterLink, 0, len(activeLinks))
+	for link := range activeLinks {
+		links = append(links, link)
+	}
+	activeLock.Unlock()
+
+	for _, link := range links {
+		link.Lock()
+		masterLinks.add(1, link.state)
+		masterQueueLength.add(float64(len(link.masterchannel)))
+		if link.state == "streaming" {
+			masterReplOffset.set(float64(link.offset))
+		}
+		for _, s := range link.slaves {
+			addr := s.conn.RemoteAddr().String()
+			slaveQueueLength.set(float64(len(s.channel)), s.shard.addr, addr)
+			if offset, ok := link.acks[s]; ok {
+				slaveAckOffset.set(float64(offset), s.shard.addr, addr)
+			}
+		}
+		link.Unlock()
+	}
+}
+
+// Write all metrics in Prometheus text format
+func writeMetrics(w io.Writer) {
+	collectLock.Lock()
+	defer collectLock.Unlock()
+
+	collectMetrics()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// HTTP handler for metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// Serve metrics over HTTP at /metrics
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	log.Printf("Serving metrics at http://%s/metrics\n", addr)
+
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Fatalf("Unable to serve metrics: %v\n", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricWrite(t *testing.T) {
+	m := &metric{
+		name:   "test_total",
+		help:   "Test metric",
+		kind:   "counter",
+		labels: []string{"shard", "command"},
+		values: make(map[string]*metricValue),
+	}
+
+	m.add(1, "b", "SET")
+	m.add(2, "a", "SET")
+	m.add(1, "a", "SET")
+	m.add(1.5, "a", "quote\"back\\slash\nnewline")
+
+	var buf bytes.Buffer
+	m.write(&buf)
+
+	expected := "# HELP test_total Test metric\n" +
+		"# TYPE test_total counter\n" +
+		"test_total{shard=\"a\",command=\"SET\"} 3\n" +
+		"test_total{shard=\"a\",command=\"quote\\\"back\\\\slash\\nnewline\"} 1.5\n" +
+		"test_total{shard=\"b\",command=\"SET\"} 1\n"
+
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	m = &metric{name: "test_gauge", help: "Test gauge", kind: "gauge", values: make(map[string]*metricValue)}
+	m.set(42)
+
+	buf.Reset()
+	m.write(&buf)
+
+	expected = "# HELP test_gauge Test gauge\n# TYPE test_gauge gauge\ntest_gauge 42\n"
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestRDBMetrics(t *testing.T) {
+	rdbReadBytes.reset()
+	rdbWrittenBytes.reset()
+	rdbKeys.reset()
+
+	filtered := filterRDBString(RDBFile1, func(key string) bool { return strings.HasPrefix(key, "a_") })
+
+	tests := []struct {
+		description string
+		m           *metric
+		labels      []string
+		expected    float64
+	}{
+		{"1: Bytes read", rdbReadBytes, nil, float64(len(RDBFile1))},
+		{"2: Bytes written", rdbWrittenBytes, []string{""}, float64(len(filtered))},
+		{"3: Keys kept", rdbKeys, []string{"", "string", "kept"}, 2},
+		{"4: Keys dropped", rdbKeys, []string{"", "string", "dropped"}, 3},
+		{"5: Other types", rdbKeys, []string{"", "hash", "kept"}, 0},
+	}
+
+	for _, test := range tests {
+		value := test.m.get(test.labels...)
+		if value != test.expected {
+			t.Errorf("Metric value %v != %v (test %s)", value, test.expected, test.description)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Unexpected content type: %#v", recorder.Header().Get("Content-Type"))
+	}
+
+	body := recorder.Body.String()
+
+	for _, expected := range []string{
+		"# TYPE redis_resharding_proxy_rdb_read_bytes_total counter\n",
+		"# TYPE redis_resharding_proxy_slaves_connected gauge\n",
+		"redis_resharding_proxy_master_links{state=\"streaming\"} ",
+		"redis_resharding_proxy_master_queue_length 0\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Metrics should contain %#v:\n%s", expected, body)
+		}
+	}
+}
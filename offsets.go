@@ -0,0 +1,169 @@
+package main
+
+// Mapping between replication offsets of master and filtered stream as seen by slave
+
+import (
+	"sort"
+	"sync"
+)
+
+// offsetCheckpoint is a point where slave offset and master offset are known to correspond
+type offsetCheckpoint struct {
+	slave  int64
+	master int64
+}
+
+// offsetMap tracks replication offsets of master and slave. As some commands are filtered out,
+// slave offset lags behind master offset. Between checkpoints difference between offsets stays constant.
+// Database currently selected in replication stream is tracked as well, as master doesn't repeat SELECT
+// after partial resynchronization.
+type offsetMap struct {
+	sync.Mutex
+	replID      string
+	db          int
+	slave       int64
+	master      int64
+	checkpoints []offsetCheckpoint
+	pending     *offsetCheckpoint
+}
+
+// Copy replication history, so that it could be continued by another slave without affecting
+// slave which map belongs to. Pending PSYNC request isn't copied
+func (m *offsetMap) clone() *offsetMap {
+	m.Lock()
+	defer m.Unlock()
+
+	return &offsetMap{
+		replID:      m.replID,
+		db:          m.db,
+		slave:       m.slave,
+		master:      m.master,
+		checkpoints: append([]offsetCheckpoint(nil), m.checkpoints...),
+	}
+}
+
+// Start new replication history after full resynchronization
+func (m *offsetMap) reset(replID string, offset int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.replID = replID
+	m.db = 0
+	m.slave = offset
+	m.master = offset
+	m.checkpoints = []offsetCheckpoint{{slave: offset, master: offset}}
+	m.pending = nil
+}
+
+// Advance offsets after command has been processed: masterBytes were consumed from master
+// and slaveBytes were sent to slave
+func (m *offsetMap) advance(masterBytes, slaveBytes int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.checkpoints == nil {
+		return
+	}
+
+	m.master += masterBytes
+	m.slave += slaveBytes
+
+	if masterBytes == slaveBytes {
+		return
+	}
+
+	last := &m.checkpoints[len(m.checkpoints)-1]
+	if last.slave == m.slave {
+		last.master = m.master
+	} else {
+		m.checkpoints = append(m.checkpoints, offsetCheckpoint{slave: m.slave, master: m.master})
+	}
+}
+
+// Translate slave offset to master offset, should be called with lock held
+func (m *offsetMap) lookup(offset int64) (int, int64, bool) {
+	if m.checkpoints == nil || offset < m.checkpoints[0].slave || offset > m.slave {
+		return 0, 0, false
+	}
+
+	i := sort.Search(len(m.checkpoints), func(i int) bool { return m.checkpoints[i].slave > offset }) - 1
+	checkpoint := m.checkpoints[i]
+
+	return i, offset - checkpoint.slave + checkpoint.master, true
+}
+
+// Translate slave offset to master offset
+func (m *offsetMap) toMaster(offset int64) (int64, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	_, result, ok := m.lookup(offset)
+	return result, ok
+}
+
+// Translate offset from slave ACK, forgetting history before it
+func (m *offsetMap) ack(offset int64) (int64, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	i, result, ok := m.lookup(offset)
+	if ok && i > 0 {
+		m.checkpoints = append(m.checkpoints[:0], m.checkpoints[i:]...)
+	}
+
+	return result, ok
+}
+
+// Translate PSYNC request from slave, remembering it until master replies. Slave requests
+// offset of the next byte it needs (processed offset + 1), so is the result
+func (m *offsetMap) psync(replID string, offset int64) (int64, bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if replID != m.replID {
+		return 0, false
+	}
+
+	_, result, ok := m.lookup(offset - 1)
+	if ok {
+		m.pending = &offsetCheckpoint{slave: offset - 1, master: result}
+	}
+
+	return result + 1, ok
+}
+
+// Master accepted partial resynchronization, rewind offsets to the point slave requested
+func (m *offsetMap) resume(replID string) {
+	m.Lock()
+	defer m.Unlock()
+
+	if replID != "" {
+		m.replID = replID
+	}
+
+	if m.pending == nil {
+		return
+	}
+
+	i := sort.Search(len(m.checkpoints), func(i int) bool { return m.checkpoints[i].slave > m.pending.slave })
+	m.checkpoints = append(m.checkpoints[:i], *m.pending)
+	m.slave = m.pending.slave
+	m.master = m.pending.master
+	m.pending = nil
+}
+
+// Remember database selected in replication stream
+func (m *offsetMap) selectDB(db int) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.db = db
+}
+
+// Database selected in replication stream
+func (m *offsetMap) currentDB() int {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.db
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestOffsetMap(t *testing.T) {
+	m := &offsetMap{}
+
+	if _, ok := m.toMaster(100); ok {
+		t.Errorf("empty map shouldn't translate offsets")
+	}
+
+	m.reset("abc", 100)
+	m.advance(10, 10)
+	m.advance(20, 0)
+	m.advance(5, 0)
+	m.advance(10, 10)
+	m.advance(7, 0)
+
+	tests := []struct {
+		slave  int64
+		master int64
+		ok     bool
+	}{
+		{99, 0, false},
+		{100, 100, true},
+		{105, 105, true},
+		{110, 135, true},
+		{115, 140, true},
+		{120, 152, true},
+		{121, 0, false},
+	}
+
+	for _, test := range tests {
+		master, ok := m.toMaster(test.slave)
+		if ok != test.ok || ok && master != test.master {
+			t.Errorf("toMaster(%d) = %d, %v != %d, %v", test.slave, master, ok, test.master, test.ok)
+		}
+	}
+
+	master, ok := m.ack(115)
+	if !ok || master != 140 {
+		t.Errorf("ack(115) = %d, %v != 140, true", master, ok)
+	}
+
+	if _, ok = m.toMaster(105); ok {
+		t.Errorf("offsets before ACK should be forgotten")
+	}
+
+	if _, ok = m.psync("def", 116); ok {
+		t.Errorf("psync with wrong replication ID should fail")
+	}
+
+	if _, ok = m.psync("abc", 122); ok {
+		t.Errorf("psync beyond processed offset should fail")
+	}
+
+	master, ok = m.psync("abc", 121)
+	if !ok || master != 153 {
+		t.Errorf("psync(121) = %d, %v != 153, true", master, ok)
+	}
+
+	// slave processed up to 115, so it asks for 116
+	master, ok = m.psync("abc", 116)
+	if !ok || master != 141 {
+		t.Errorf("psync(116) = %d, %v != 141, true", master, ok)
+	}
+
+	m.resume("xyz")
+	m.advance(3, 3)
+
+	if m.replID != "xyz" || m.slave != 118 || m.master != 143 {
+		t.Errorf("unexpected state after resume: %#v", m)
+	}
+
+	master, ok = m.toMaster(118)
+	if !ok || master != 143 {
+		t.Errorf("toMaster(118) = %d, %v != 143, true", master, ok)
+	}
+
+	// clone continues replication history independently of original map
+	c := m.clone()
+	if _, ok = c.psync("xyz", 117); !ok {
+		t.Errorf("psync on clone should succeed")
+	}
+	c.resume("new")
+	c.advance(5, 2)
+
+	if c.replID != "new" || c.slave != 118 || c.master != 146 {
+		t.Errorf("unexpected state of clone: %#v", c)
+	}
+
+	if m.replID != "xyz" || m.slave != 118 || m.master != 143 || m.pending != nil {
+		t.Errorf("original map changed by clone: %#v", m)
+	}
+
+	master, ok = m.toMaster(118)
+	if !ok || master != 143 {
+		t.Errorf("toMaster(118) = %d, %v != 143, true after clone", master, ok)
+	}
+}
@@ -10,33 +10,107 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"time"
 )
 
 const (
-	rdbOpDB         = 0xFE
-	rdbOpExpirySec  = 0xFD
-	rdbOpExpiryMSec = 0xFC
-	rdbOpEOF        = 0xFF
+	rdbVersionMax = 12
+
+	rdbOpSlotInfo      = 0xF4
+	rdbOpFunction      = 0xF5
+	rdbOpFunctionPreGA = 0xF6
+	rdbOpModuleAux     = 0xF7
+	rdbOpIdle          = 0xF8
+	rdbOpFreq          = 0xF9
+	rdbOpAux           = 0xFA
+	rdbOpResizeDB      = 0xFB
+	rdbOpDB            = 0xFE
+	rdbOpExpirySec     = 0xFD
+	rdbOpExpiryMSec    = 0xFC
+	rdbOpEOF           = 0xFF
 
 	rdbLen6Bit  = 0x0
 	rdbLen14bit = 0x1
 	rdbLen32Bit = 0x2
 	rdbLenEnc   = 0x3
 
+	rdbLen64BitPrefix = 0x81
+
 	rdbOpString    = 0x00
 	rdbOpList      = 0x01
 	rdbOpSet       = 0x02
 	rdbOpZset      = 0x03
 	rdbOpHash      = 0x04
+	rdbOpZset2     = 0x05
+	rdbOpModule    = 0x06
+	rdbOpModule2   = 0x07
 	rdbOpZipmap    = 0x09
 	rdbOpZiplist   = 0x0a
 	rdbOpIntset    = 0x0b
 	rdbOpSortedSet = 0x0c
 	rdbOpHashmap   = 0x0d
+
+	rdbOpQuicklist           = 0x0e
+	rdbOpStreamListpacks     = 0x0f
+	rdbOpHashListpack        = 0x10
+	rdbOpZsetListpack        = 0x11
+	rdbOpQuicklist2          = 0x12
+	rdbOpStreamListpacks2    = 0x13
+	rdbOpSetListpack         = 0x14
+	rdbOpStreamListpacks3    = 0x15
+	rdbOpHashMetadataPreGA   = 0x16
+	rdbOpHashListpackExPreGA = 0x17
+	rdbOpHashMetadata        = 0x18
+	rdbOpHashListpackEx      = 0x19
+
+	rdbQuicklistNodePlain  = 1
+	rdbQuicklistNodePacked = 2
+
+	rdbStreamIDSize = 16
+
+	rdbModuleOpEOF    = 0
+	rdbModuleOpSInt   = 1
+	rdbModuleOpUInt   = 2
+	rdbModuleOpFloat  = 3
+	rdbModuleOpDouble = 4
+	rdbModuleOpString = 5
 )
 
 var (
 	rdbSignature = []byte{0x52, 0x45, 0x44, 0x49, 0x53}
+
+	// how often progress of RDB filtering is reported
+	rdbProgressInterval = 10 * time.Second
+	// how many bytes are read between checks whether progress should be reported
+	rdbProgressCheckBytes int64 = 64 * 1024
+
+	// names of value types by opcode, as reported by TYPE command
+	rdbTypeNames = map[byte]string{
+		rdbOpString:              "string",
+		rdbOpList:                "list",
+		rdbOpQuicklist:           "list",
+		rdbOpQuicklist2:          "list",
+		rdbOpZiplist:             "list",
+		rdbOpSet:                 "set",
+		rdbOpIntset:              "set",
+		rdbOpSetListpack:         "set",
+		rdbOpZset:                "zset",
+		rdbOpZset2:               "zset",
+		rdbOpSortedSet:           "zset",
+		rdbOpZsetListpack:        "zset",
+		rdbOpHash:                "hash",
+		rdbOpZipmap:              "hash",
+		rdbOpHashmap:             "hash",
+		rdbOpHashListpack:        "hash",
+		rdbOpHashMetadataPreGA:   "hash",
+		rdbOpHashListpackExPreGA: "hash",
+		rdbOpHashMetadata:        "hash",
+		rdbOpHashListpackEx:      "hash",
+		rdbOpStreamListpacks:     "stream",
+		rdbOpStreamListpacks2:    "stream",
+		rdbOpStreamListpacks3:    "stream",
+		rdbOpModule2:             "module",
+	}
 )
 
 var (
@@ -48,36 +122,172 @@ var (
 	ErrUnsupportedOp = errors.New("rdb: unsupported opcode")
 	// ErrUnsupportedStringEnc is returned when unsupported string encoding is encountered in RDB
 	ErrUnsupportedStringEnc = errors.New("rdb: unsupported string encoding")
+	// ErrWrongEOFMark is returned when RDB transferred in diskless mode isn't followed by EOF mark
+	ErrWrongEOFMark = errors.New("rdb: wrong EOF mark")
+	// ErrUnsupportedModuleOp is returned when unsupported opcode is encountered in module data
+	ErrUnsupportedModuleOp = errors.New("rdb: unsupported module opcode")
+	// ErrUnsupportedModule is returned when module value is stored in format which can't be parsed without the module
+	ErrUnsupportedModule = errors.New("rdb: module value without opcodes is unsupported")
 )
 
 // RDBFilter holds internal state of RDB filter while running
 type RDBFilter struct {
 	reader         *bufio.Reader
-	output         chan<- []byte
-	dissector      func(string) bool
+	outputs        []*RDBOutput
 	originalLength int64
-	length         int64
-	hash           uint64
-	saved          []byte
+	read           int64
+	reported       int64
+	nextCheck      int64
+	keys           int64
+	keptKeys       int64
+	started        time.Time
+	lastProgress   time.Time
+	progress       func(RDBProgress)
+	eofMark        []byte
 	rdbVersion     int
 	valueState     state
-	shouldKeep     bool
 	currentOp      byte
+	currentDB      int
+}
+
+// RDBProgress is a snapshot of RDB filtering progress
+type RDBProgress struct {
+	// bytes read so far and original length of RDB (zero or negative if unknown)
+	Read, Length int64
+	// bytes of filtered RDB written to all outputs
+	Written int64
+	// keys read so far and keys kept by at least one output
+	Keys, KeptKeys int64
+	Elapsed        time.Duration
+	Finished       bool
+}
+
+// Throughput returns average read speed in bytes per second
+func (progress RDBProgress) Throughput() float64 {
+	if progress.Elapsed <= 0 {
+		return 0
+	}
+
+	return float64(progress.Read) / progress.Elapsed.Seconds()
+}
+
+// Percent returns percentage of RDB read so far, false if length of RDB is unknown
+func (progress RDBProgress) Percent() (float64, bool) {
+	if progress.Length <= 0 {
+		return 0, false
+	}
+
+	return 100 * float64(progress.Read) / float64(progress.Length), true
+}
+
+// ETA returns estimated time to finish reading RDB, false if it can't be estimated
+func (progress RDBProgress) ETA() (time.Duration, bool) {
+	if progress.Finished {
+		return 0, true
+	}
+
+	throughput := progress.Throughput()
+	if progress.Length <= 0 || throughput <= 0 {
+		return 0, false
+	}
+
+	remaining := float64(progress.Length - progress.Read)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return time.Duration(remaining / throughput * float64(time.Second)).Truncate(time.Second), true
+}
+
+// Format number of bytes in human-readable form
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (progress RDBProgress) String() string {
+	result := fmt.Sprintf("read %s", formatBytes(progress.Read))
+
+	if percent, ok := progress.Percent(); ok {
+		result += fmt.Sprintf(" of %s (%.1f%%)", formatBytes(progress.Length), percent)
+	}
+
+	result += fmt.Sprintf(", written %s, keys %d (kept %d), %s/s", formatBytes(progress.Written),
+		progress.Keys, progress.KeptKeys, formatBytes(int64(progress.Throughput())))
+
+	if eta, ok := progress.ETA(); ok && !progress.Finished {
+		result += fmt.Sprintf(", ETA %v", eta)
+	} else if progress.Finished {
+		result += fmt.Sprintf(", took %v", progress.Elapsed.Truncate(time.Millisecond))
+	}
+
+	return result
+}
+
+// RDBOutput is a destination for filtered RDB, each output has its own dissector
+type RDBOutput struct {
+	// name of output used in metrics
+	name       string
+	channel    chan<- []byte
+	dissector  func(int, string) bool
+	length     int64
+	hash       uint64
+	saved      []byte
+	shouldKeep bool
+	// database numbers are rewritten according to dbMap (if set)
+	dbMap map[int]int
+	// keys are renamed with transform function (if set)
+	transform func(string) string
 }
 
 type state func(filter *RDBFilter) (nextstate state, err error)
 
+// NewRDBOutput creates destination for filtered RDB: chunks of data are sent through channel,
+// dissector function is applied to database number and key to check whether item should be kept or skipped
+func NewRDBOutput(channel chan<- []byte, dissector func(int, string) bool) *RDBOutput {
+	return &RDBOutput{
+		channel:    channel,
+		dissector:  dissector,
+		shouldKeep: true,
+	}
+}
+
 // FilterRDB filters RDB file which is read from reader, sending chunks of data through output channel
 // dissector function is applied to keys to check whether item should be kept or skipped
-// length is original length of RDB file
-func FilterRDB(reader *bufio.Reader, output chan<- []byte, dissector func(string) bool, length int64) (err error) {
+// length is original length of RDB file, if eofMark is not nil, RDB is transferred in diskless mode: length is unknown
+// and RDB is followed by eofMark (which is consumed, but not sent to output)
+// Filtered RDB is sent to output as is, without any framing, so its length is usually less than original length
+func FilterRDB(reader *bufio.Reader, output chan<- []byte, dissector func(string) bool, length int64, eofMark []byte) (err error) {
+	keyDissector := func(db int, key string) bool { return dissector(key) }
+	return FilterRDBOutputs(reader, []*RDBOutput{NewRDBOutput(output, keyDissector)}, length, eofMark, nil)
+}
+
+// FilterRDBOutputs filters RDB file once for several outputs, see FilterRDB
+// If progress is not nil, it is called periodically while RDB is filtered (see rdbProgressInterval)
+// and once filtering is finished
+func FilterRDBOutputs(reader *bufio.Reader, outputs []*RDBOutput, length int64, eofMark []byte, progress func(RDBProgress)) (err error) {
 	filter := &RDBFilter{
 		reader:         reader,
-		output:         output,
-		dissector:      dissector,
+		outputs:        outputs,
 		originalLength: length,
-		shouldKeep:     true,
+		eofMark:        eofMark,
+		progress:       progress,
+		started:        time.Now(),
 	}
+	filter.lastProgress = filter.started
+
+	defer filter.reportRead()
 
 	state := stateMagic
 
@@ -88,44 +298,121 @@ func FilterRDB(reader *bufio.Reader, output chan<- []byte, dissector func(string
 		}
 	}
 
+	filter.reportProgress(true)
+
 	return nil
 }
 
-// Read exactly n bytes
-func (filter *RDBFilter) safeRead(n uint32) (result []byte, err error) {
+// Read exactly n bytes, large strings are read in chunks so that progress is reported
+func (filter *RDBFilter) safeRead(n uint64) (result []byte, err error) {
 	result = make([]byte, n)
-	_, err = io.ReadFull(filter.reader, result)
+
+	for offset := uint64(0); offset < n; {
+		chunk := n - offset
+		if chunk > uint64(rdbProgressCheckBytes) {
+			chunk = uint64(rdbProgressCheckBytes)
+		}
+
+		var read int
+		read, err = io.ReadFull(filter.reader, result[offset:offset+chunk])
+		filter.consumed(read)
+		if err != nil {
+			return
+		}
+		offset += uint64(read)
+	}
+
 	return
 }
 
-// Accumulate some data that might be either filtered out or passed through
-func (filter *RDBFilter) write(data []byte) {
-	if !filter.shouldKeep {
+// Read single byte
+func (filter *RDBFilter) readByte() (byte, error) {
+	b, err := filter.reader.ReadByte()
+	if err == nil {
+		filter.consumed(1)
+	}
+	return b, err
+}
+
+// Account for n bytes read from RDB, reporting progress from time to time
+// (even while skipping over single large value)
+func (filter *RDBFilter) consumed(n int) {
+	filter.read += int64(n)
+
+	if filter.read >= filter.nextCheck {
+		filter.nextCheck = filter.read + rdbProgressCheckBytes
+		filter.reportRead()
+		filter.reportProgress(false)
+	}
+}
+
+// Update metrics with number of bytes read since last report
+func (filter *RDBFilter) reportRead() {
+	rdbReadBytes.add(float64(filter.read - filter.reported))
+	filter.reported = filter.read
+}
+
+// Report progress if reporting interval has passed or filtering is finished
+func (filter *RDBFilter) reportProgress(finished bool) {
+	if filter.progress == nil {
 		return
 	}
 
-	if filter.saved == nil {
-		filter.saved = make([]byte, len(data), 4096)
-		copy(filter.saved, data)
-	} else {
-		filter.saved = append(filter.saved, data...)
+	now := time.Now()
+	if !finished && now.Sub(filter.lastProgress) < rdbProgressInterval {
+		return
+	}
+	filter.lastProgress = now
+
+	progress := RDBProgress{
+		Read:     filter.read,
+		Length:   filter.originalLength,
+		Keys:     filter.keys,
+		KeptKeys: filter.keptKeys,
+		Elapsed:  now.Sub(filter.started),
+		Finished: finished,
+	}
+
+	for _, output := range filter.outputs {
+		progress.Written += output.length
+	}
+
+	filter.progress(progress)
+}
+
+// Accumulate some data that might be either filtered out or passed through
+func (filter *RDBFilter) write(data []byte) {
+	for _, output := range filter.outputs {
+		if !output.shouldKeep {
+			continue
+		}
+
+		if output.saved == nil {
+			output.saved = make([]byte, len(data), 4096)
+			copy(output.saved, data)
+		} else {
+			output.saved = append(output.saved, data...)
+		}
 	}
 }
 
 // Discard or keep saved data
 func (filter *RDBFilter) keepOrDiscard() {
-	if filter.shouldKeep && filter.saved != nil {
-		filter.output <- filter.saved
-		filter.hash = CRC64Update(filter.hash, filter.saved)
-		filter.length += int64(len(filter.saved))
+	for _, output := range filter.outputs {
+		if output.shouldKeep && output.saved != nil {
+			output.channel <- output.saved
+			output.hash = CRC64Update(output.hash, output.saved)
+			output.length += int64(len(output.saved))
+			rdbWrittenBytes.add(float64(len(output.saved)), output.name)
+		}
+		output.saved = nil
+		output.shouldKeep = true
 	}
-	filter.saved = nil
-	filter.shouldKeep = true
 }
 
 // Read length encoded prefix
-func (filter *RDBFilter) readLength() (length uint32, encoding int8, err error) {
-	prefix, err := filter.reader.ReadByte()
+func (filter *RDBFilter) readLength() (length uint64, encoding int8, err error) {
+	prefix, err := filter.readByte()
 	if err != nil {
 		return 0, 0, err
 	}
@@ -135,23 +422,32 @@ func (filter *RDBFilter) readLength() (length uint32, encoding int8, err error)
 
 	switch kind {
 	case rdbLen6Bit:
-		length = uint32(prefix & 0x3F)
+		length = uint64(prefix & 0x3F)
 		return length, -1, nil
 	case rdbLen14bit:
-		data, err := filter.reader.ReadByte()
+		data, err := filter.readByte()
 		if err != nil {
 			return 0, 0, err
 		}
 		filter.write([]byte{data})
-		length = ((uint32(prefix) & 0x3F) << 8) | uint32(data)
+		length = ((uint64(prefix) & 0x3F) << 8) | uint64(data)
 		return length, -1, nil
 	case rdbLen32Bit:
+		if prefix == rdbLen64BitPrefix {
+			data, err := filter.safeRead(8)
+			if err != nil {
+				return 0, 0, err
+			}
+			filter.write(data)
+			length = binary.BigEndian.Uint64(data)
+			return length, -1, nil
+		}
 		data, err := filter.safeRead(4)
 		if err != nil {
 			return 0, 0, err
 		}
 		filter.write(data)
-		length = binary.BigEndian.Uint32(data)
+		length = uint64(binary.BigEndian.Uint32(data))
 		return length, -1, nil
 	case rdbLenEnc:
 		encoding = int8(prefix & 0x3F)
@@ -160,6 +456,29 @@ func (filter *RDBFilter) readLength() (length uint32, encoding int8, err error)
 	panic("never reached")
 }
 
+// Encode length prefix
+func encodeLength(length uint64) []byte {
+	switch {
+	case length < 1<<6:
+		return []byte{byte(length)}
+	case length < 1<<14:
+		return []byte{rdbLen14bit<<6 | byte(length>>8), byte(length)}
+	case length < 1<<32:
+		result := []byte{rdbLen32Bit << 6, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(result[1:], uint32(length))
+		return result
+	}
+
+	result := []byte{rdbLen64BitPrefix, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(result[1:], length)
+	return result
+}
+
+// Encode string without compression
+func encodeString(s string) []byte {
+	return append(encodeLength(uint64(len(s))), s...)
+}
+
 // Taken from Golly: https://github.com/tav/golly/blob/master/lzf/lzf.go
 // Removed part that gets outputLength from data
 func lzfDecompress(input []byte, outputLength uint32) (output []byte) {
@@ -307,7 +626,7 @@ func (filter *RDBFilter) readString() (string, error) {
 		}
 		filter.write(data)
 
-		result = string(lzfDecompress(data, length))
+		result = string(lzfDecompress(data, uint32(length)))
 	default:
 		return "", ErrUnsupportedStringEnc
 	}
@@ -378,7 +697,7 @@ func stateMagic(filter *RDBFilter) (state, error) {
 		return nil, ErrWrongSignature
 	}
 
-	if version > 6 {
+	if version > rdbVersionMax {
 		return nil, ErrVersionUnsupported
 	}
 
@@ -391,7 +710,7 @@ func stateMagic(filter *RDBFilter) (state, error) {
 
 // main selector of operations
 func stateOp(filter *RDBFilter) (state, error) {
-	op, err := filter.reader.ReadByte()
+	op, err := filter.readByte()
 	if err != nil {
 		return nil, err
 	}
@@ -405,15 +724,55 @@ func stateOp(filter *RDBFilter) (state, error) {
 		return stateExpirySec, nil
 	case rdbOpExpiryMSec:
 		return stateExpiryMSec, nil
-	case rdbOpString, rdbOpZipmap, rdbOpZiplist, rdbOpIntset, rdbOpSortedSet, rdbOpHashmap:
+	case rdbOpIdle:
+		return stateIdle, nil
+	case rdbOpFreq:
+		return stateFreq, nil
+	case rdbOpAux:
+		filter.keepOrDiscard()
+		return stateAux, nil
+	case rdbOpResizeDB:
+		filter.keepOrDiscard()
+		return stateResizeDB, nil
+	case rdbOpSlotInfo:
+		filter.keepOrDiscard()
+		return stateSlotInfo, nil
+	case rdbOpModuleAux:
+		filter.keepOrDiscard()
+		return stateModuleAux, nil
+	case rdbOpFunction, rdbOpFunctionPreGA:
+		filter.keepOrDiscard()
+		return stateFunction, nil
+	case rdbOpString, rdbOpZipmap, rdbOpZiplist, rdbOpIntset, rdbOpSortedSet, rdbOpHashmap,
+		rdbOpHashListpack, rdbOpZsetListpack, rdbOpSetListpack:
 		filter.valueState = stateSkipString
 		return stateKey, nil
-	case rdbOpList, rdbOpSet:
+	case rdbOpList, rdbOpSet, rdbOpQuicklist:
 		filter.valueState = stateSkipSetOrList
 		return stateKey, nil
+	case rdbOpQuicklist2:
+		filter.valueState = stateSkipQuicklist2
+		return stateKey, nil
+	case rdbOpHashMetadata, rdbOpHashMetadataPreGA:
+		filter.valueState = stateSkipHashMetadata
+		return stateKey, nil
+	case rdbOpHashListpackEx, rdbOpHashListpackExPreGA:
+		filter.valueState = stateSkipHashListpackEx
+		return stateKey, nil
+	case rdbOpStreamListpacks, rdbOpStreamListpacks2, rdbOpStreamListpacks3:
+		filter.valueState = stateSkipStream
+		return stateKey, nil
+	case rdbOpModule2:
+		filter.valueState = stateSkipModule
+		return stateKey, nil
+	case rdbOpModule:
+		return nil, ErrUnsupportedModule
 	case rdbOpZset:
 		filter.valueState = stateSkipZset
 		return stateKey, nil
+	case rdbOpZset2:
+		filter.valueState = stateSkipZset2
+		return stateKey, nil
 	case rdbOpHash:
 		filter.valueState = stateSkipHash
 		return stateKey, nil
@@ -424,7 +783,7 @@ func stateOp(filter *RDBFilter) (state, error) {
 		if filter.rdbVersion > 4 {
 			return stateCRC64, nil
 		}
-		return statePadding, nil
+		return filter.trailerState(), nil
 	default:
 		return nil, ErrUnsupportedOp
 	}
@@ -433,10 +792,17 @@ func stateOp(filter *RDBFilter) (state, error) {
 // DB index operation
 func stateDB(filter *RDBFilter) (state, error) {
 	filter.write([]byte{rdbOpDB})
-	_, _, err := filter.readLength()
+	db, _, err := filter.readLength()
 	if err != nil {
 		return nil, err
 	}
+	filter.currentDB = int(db)
+
+	for _, output := range filter.outputs {
+		if mapped, exists := output.dbMap[filter.currentDB]; exists && output.shouldKeep {
+			output.saved = append([]byte{rdbOpDB}, encodeLength(uint64(mapped))...)
+		}
+	}
 	filter.keepOrDiscard()
 
 	return stateOp, nil
@@ -466,15 +832,212 @@ func stateExpiryMSec(filter *RDBFilter) (state, error) {
 	return stateOp, nil
 }
 
+// LRU idle time of the key which follows
+func stateIdle(filter *RDBFilter) (state, error) {
+	filter.write([]byte{rdbOpIdle})
+	_, _, err := filter.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	return stateOp, nil
+}
+
+// LFU frequency of the key which follows
+func stateFreq(filter *RDBFilter) (state, error) {
+	freq, err := filter.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	filter.write([]byte{rdbOpFreq, freq})
+
+	return stateOp, nil
+}
+
+// auxiliary field: key and value
+func stateAux(filter *RDBFilter) (state, error) {
+	filter.write([]byte{rdbOpAux})
+
+	err := filter.skipString()
+	if err != nil {
+		return nil, err
+	}
+
+	err = filter.skipString()
+	if err != nil {
+		return nil, err
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
+// hash table size hints for DB: size of main dict and expires dict
+func stateResizeDB(filter *RDBFilter) (state, error) {
+	filter.write([]byte{rdbOpResizeDB})
+
+	for i := 0; i < 2; i++ {
+		_, _, err := filter.readLength()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
+// cluster slot size hints: slot, size of main dict and expires dict
+func stateSlotInfo(filter *RDBFilter) (state, error) {
+	filter.write([]byte{rdbOpSlotInfo})
+
+	for i := 0; i < 3; i++ {
+		_, _, err := filter.readLength()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
+// module auxiliary data: module ID, when opcode, when and module data
+func stateModuleAux(filter *RDBFilter) (state, error) {
+	filter.write([]byte{rdbOpModuleAux})
+
+	for i := 0; i < 3; i++ {
+		_, _, err := filter.readLength()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := filter.skipModuleValue()
+	if err != nil {
+		return nil, err
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
+// library of functions
+func stateFunction(filter *RDBFilter) (state, error) {
+	filter.write([]byte{filter.currentOp})
+
+	if filter.currentOp == rdbOpFunctionPreGA {
+		// name, engine name
+		for i := 0; i < 2; i++ {
+			err := filter.skipString()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		hasDescription, _, err := filter.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		if hasDescription != 0 {
+			err = filter.skipString()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// function code
+	err := filter.skipString()
+	if err != nil {
+		return nil, err
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
+// skip (copy) module data encoded as sequence of opcodes with values
+func (filter *RDBFilter) skipModuleValue() error {
+	for {
+		opcode, _, err := filter.readLength()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case rdbModuleOpEOF:
+			return nil
+		case rdbModuleOpSInt, rdbModuleOpUInt:
+			_, _, err = filter.readLength()
+		case rdbModuleOpFloat:
+			err = filter.skipBytes(4)
+		case rdbModuleOpDouble:
+			err = filter.skipBytes(8)
+		case rdbModuleOpString:
+			err = filter.skipString()
+		default:
+			return ErrUnsupportedModuleOp
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skip (copy) n bytes from RDB
+func (filter *RDBFilter) skipBytes(n uint64) error {
+	data, err := filter.safeRead(n)
+	if err != nil {
+		return err
+	}
+
+	filter.write(data)
+	return nil
+}
+
 // read key
 func stateKey(filter *RDBFilter) (state, error) {
+	marks := make([]int, len(filter.outputs))
+	for i, output := range filter.outputs {
+		marks[i] = len(output.saved)
+	}
+
 	filter.write([]byte{filter.currentOp})
 	key, err := filter.readString()
 	if err != nil {
 		return nil, err
 	}
 
-	filter.shouldKeep = filter.dissector(key)
+	typeName := rdbTypeNames[filter.currentOp]
+	kept := false
+
+	for i, output := range filter.outputs {
+		output.shouldKeep = output.dissector(filter.currentDB, key)
+
+		if output.shouldKeep {
+			kept = true
+			rdbKeys.add(1, output.name, typeName, "kept")
+		} else {
+			rdbKeys.add(1, output.name, typeName, "dropped")
+		}
+
+		if output.shouldKeep && output.transform != nil {
+			newKey := output.transform(key)
+			if newKey != key {
+				// replace key as read from RDB with re-encoded one
+				output.saved = append(output.saved[:marks[i]+1], encodeString(newKey)...)
+			}
+		}
+	}
+
+	filter.keys++
+	if kept {
+		filter.keptKeys++
+	}
 
 	return filter.valueState, nil
 }
@@ -497,7 +1060,7 @@ func stateSkipSetOrList(filter *RDBFilter) (state, error) {
 		return nil, err
 	}
 
-	var i uint32
+	var i uint64
 
 	for i = 0; i < length; i++ {
 		// list element
@@ -518,7 +1081,7 @@ func stateSkipHash(filter *RDBFilter) (state, error) {
 		return nil, err
 	}
 
-	var i uint32
+	var i uint64
 
 	for i = 0; i < length; i++ {
 		// key
@@ -545,7 +1108,7 @@ func stateSkipZset(filter *RDBFilter) (state, error) {
 		return nil, err
 	}
 
-	var i uint32
+	var i uint64
 
 	for i = 0; i < length; i++ {
 		err = filter.skipString()
@@ -553,14 +1116,14 @@ func stateSkipZset(filter *RDBFilter) (state, error) {
 			return nil, err
 		}
 
-		dlen, err := filter.reader.ReadByte()
+		dlen, err := filter.readByte()
 		if err != nil {
 			return nil, err
 		}
 		filter.write([]byte{dlen})
 
 		if dlen < 0xFD {
-			double, err := filter.safeRead(uint32(dlen))
+			double, err := filter.safeRead(uint64(dlen))
 			if err != nil {
 				return nil, err
 			}
@@ -573,6 +1136,265 @@ func stateSkipZset(filter *RDBFilter) (state, error) {
 	return stateOp, nil
 }
 
+// skip over quicklist with nodes in plain or packed format
+func stateSkipQuicklist2(filter *RDBFilter) (state, error) {
+	length, _, err := filter.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var i uint64
+
+	for i = 0; i < length; i++ {
+		container, _, err := filter.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		if container != rdbQuicklistNodePlain && container != rdbQuicklistNodePacked {
+			return nil, ErrUnsupportedOp
+		}
+
+		// node contents: plain element or listpack
+		err = filter.skipString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
+// skip over hash with field expiration
+func stateSkipHashMetadata(filter *RDBFilter) (state, error) {
+	if filter.currentOp == rdbOpHashMetadata {
+		// minimal expiration time
+		err := filter.skipBytes(8)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	length, _, err := filter.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var i uint64
+
+	for i = 0; i < length; i++ {
+		// TTL
+		_, _, err = filter.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		// key
+		err = filter.skipString()
+		if err != nil {
+			return nil, err
+		}
+
+		// value
+		err = filter.skipString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
+// skip over listpack-encoded hash with field expiration
+func stateSkipHashListpackEx(filter *RDBFilter) (state, error) {
+	if filter.currentOp == rdbOpHashListpackEx {
+		// minimal expiration time
+		err := filter.skipBytes(8)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stateSkipString(filter)
+}
+
+// skip over n length-encoded numbers
+func (filter *RDBFilter) skipLengths(n int) error {
+	for i := 0; i < n; i++ {
+		_, _, err := filter.readLength()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// skip over stream: listpacks with entries, metadata and consumer groups
+func stateSkipStream(filter *RDBFilter) (state, error) {
+	listpacks, _, err := filter.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var i, j uint64
+
+	for i = 0; i < listpacks; i++ {
+		// master ID
+		err = filter.skipString()
+		if err != nil {
+			return nil, err
+		}
+
+		// listpack
+		err = filter.skipString()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// length, last ID
+	err = filter.skipLengths(3)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.currentOp != rdbOpStreamListpacks {
+		// first ID, max deleted ID, entries added
+		err = filter.skipLengths(5)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	groups, _, err := filter.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	for i = 0; i < groups; i++ {
+		// group name
+		err = filter.skipString()
+		if err != nil {
+			return nil, err
+		}
+
+		// last ID
+		err = filter.skipLengths(2)
+		if err != nil {
+			return nil, err
+		}
+
+		if filter.currentOp != rdbOpStreamListpacks {
+			// entries read
+			err = filter.skipLengths(1)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// group PEL: ID, delivery time, delivery count
+		pending, _, err := filter.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		for j = 0; j < pending; j++ {
+			err = filter.skipBytes(rdbStreamIDSize + 8)
+			if err != nil {
+				return nil, err
+			}
+
+			err = filter.skipLengths(1)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		consumers, _, err := filter.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		for j = 0; j < consumers; j++ {
+			err = filter.skipStreamConsumer()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
+// skip over stream consumer: name, seen time, active time and consumer PEL
+func (filter *RDBFilter) skipStreamConsumer() error {
+	err := filter.skipString()
+	if err != nil {
+		return err
+	}
+
+	if filter.currentOp == rdbOpStreamListpacks3 {
+		err = filter.skipBytes(16)
+	} else {
+		err = filter.skipBytes(8)
+	}
+	if err != nil {
+		return err
+	}
+
+	pending, _, err := filter.readLength()
+	if err != nil {
+		return err
+	}
+
+	return filter.skipBytes(pending * rdbStreamIDSize)
+}
+
+// skip over module value: module type ID followed by module data
+func stateSkipModule(filter *RDBFilter) (state, error) {
+	_, _, err := filter.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	err = filter.skipModuleValue()
+	if err != nil {
+		return nil, err
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
+// skip over zset with binary double scores
+func stateSkipZset2(filter *RDBFilter) (state, error) {
+	length, _, err := filter.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var i uint64
+
+	for i = 0; i < length; i++ {
+		err = filter.skipString()
+		if err != nil {
+			return nil, err
+		}
+
+		err = filter.skipBytes(8)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter.keepOrDiscard()
+	return stateOp, nil
+}
+
 // re-calculate crc64
 func stateCRC64(filter *RDBFilter) (state, error) {
 	_, err := filter.safeRead(8)
@@ -580,34 +1402,36 @@ func stateCRC64(filter *RDBFilter) (state, error) {
 		return nil, err
 	}
 
-	buf := make([]byte, 8)
+	for _, output := range filter.outputs {
+		buf := make([]byte, 8)
 
-	binary.LittleEndian.PutUint64(buf, filter.hash)
-	filter.output <- buf
-	filter.length += 8
+		binary.LittleEndian.PutUint64(buf, output.hash)
+		output.channel <- buf
+		output.length += 8
+		rdbWrittenBytes.add(8, output.name)
+	}
 
-	return statePadding, nil
+	return filter.trailerState(), nil
 }
 
-// pad RDB with 0xFF up to original length
-func statePadding(filter *RDBFilter) (state, error) {
-	const paddingSize = 4096
-
-	paddingLength := filter.originalLength - filter.length
-	paddingBlock := make([]byte, paddingSize)
+// state which follows RDB contents: EOF mark for diskless RDB, nothing otherwise
+func (filter *RDBFilter) trailerState() state {
+	if filter.eofMark != nil {
+		return stateEOFMark
+	}
+	return nil
+}
 
-	for i := range paddingBlock {
-		paddingBlock[i] = 0xFF
+// check EOF mark after diskless RDB
+func stateEOFMark(filter *RDBFilter) (state, error) {
+	mark, err := filter.safeRead(uint64(len(filter.eofMark)))
+	if err != nil {
+		return nil, err
 	}
 
-	for paddingLength > 0 {
-		if paddingLength > paddingSize {
-			filter.output <- paddingBlock
-			paddingLength -= paddingSize
-		} else {
-			filter.output <- paddingBlock[:paddingLength]
-			break
-		}
+	if bytes.Compare(mark, filter.eofMark) != 0 {
+		return nil, ErrWrongEOFMark
 	}
+
 	return nil, nil
 }
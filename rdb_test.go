@@ -3,9 +3,11 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
 	"io"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestFilterRDB(t *testing.T) {
@@ -26,7 +28,7 @@ func TestFilterRDB(t *testing.T) {
 		{
 			description:   "2: Simple RDB, filter out b_",
 			rdb:           RDBFile1,
-			expected:      "REDIS0006\xfe\x00\x00\x03a_1\x04lala\x00\x03a_2\xc0!\xff\xad}0`\xa6\xf4\xa1\xab" + strings.Repeat("\xff", 56),
+			expected:      "REDIS0006\xfe\x00\x00\x03a_1\x04lala\x00\x03a_2\xc0!\xff\xad}0`\xa6\xf4\xa1\xab",
 			expectedError: nil,
 			filter:        func(key string) bool { return strings.HasPrefix(key, "a_") },
 		},
@@ -39,7 +41,7 @@ func TestFilterRDB(t *testing.T) {
 		},
 		{
 			description:   "4: RDB version unsupported",
-			rdb:           "REDIS0007",
+			rdb:           "REDIS0013",
 			expected:      "",
 			expectedError: ErrVersionUnsupported,
 			filter:        func(string) bool { return true },
@@ -81,13 +83,13 @@ func TestFilterRDB(t *testing.T) {
 		{
 			description: "10: Old RDB, many types, fully filtered out",
 			rdb:         RDBFile2,
-			expected:    "REDIS0001\xfe\x00\xfe\x06\xfe\x07\xfe\x08\xfe\t\xfe\x0b\xfe\x0e\xfe\x0f\xff" + strings.Repeat("\xff", 1546),
+			expected:    "REDIS0001\xfe\x00\xfe\x06\xfe\x07\xfe\x08\xfe\t\xfe\x0b\xfe\x0e\xfe\x0f\xff",
 			filter:      func(string) bool { return false },
 		},
 		{
 			description: "11: Old RDB, many types, some filtered out",
 			rdb:         RDBFile2,
-			expected:    "REDIS0001\xfe\x00\xfe\x06\x02\x0bv02d_um_109\x01 86756ab85811f6603e59c6d5911c858c\x02\x0bv02e_um_108\x01 86756ab85811f6603e59c6d5911c858c\xfe\x07\xfe\x08\xfe\t\xfe\x0b\xfe\x0e\xfe\x0f\x02\x0bv02e_um_108\x01 86756ab85811f6603e59c6d5911c858c\x02\x0bv02d_um_109\x01 86756ab85811f6603e59c6d5911c858c\xff" + strings.Repeat("\xff", 1358),
+			expected:    "REDIS0001\xfe\x00\xfe\x06\x02\x0bv02d_um_109\x01 86756ab85811f6603e59c6d5911c858c\x02\x0bv02e_um_108\x01 86756ab85811f6603e59c6d5911c858c\xfe\x07\xfe\x08\xfe\t\xfe\x0b\xfe\x0e\xfe\x0f\x02\x0bv02e_um_108\x01 86756ab85811f6603e59c6d5911c858c\x02\x0bv02d_um_109\x01 86756ab85811f6603e59c6d5911c858c\xff",
 			filter:      func(key string) bool { return strings.HasPrefix(key, "v02") },
 		},
 		{
@@ -99,70 +101,360 @@ func TestFilterRDB(t *testing.T) {
 		{
 			description: "13: RDB with integer keys",
 			rdb:         RDBFile4,
-			expected:    "REDIS0006\xfe\x00\x00\xc0\f\x03abc\x00\u0087\xd6\x12\x00\x03fgh\xffQ\a\xb5\t\xfb\xe8ɦ\xff\xff\xff\xff\xff\xff\xff\xff",
+			expected:    "REDIS0006\xfe\x00\x00\xc0\f\x03abc\x00\u0087\xd6\x12\x00\x03fgh\xffQ\a\xb5\t\xfb\xe8ɦ",
 			filter:      func(key string) bool { return strings.HasPrefix(key, "1") },
 		},
 		{
 			description: "14: RDB with lzf compressed strings",
 			rdb:         RDBFile5,
-			expected:    "REDIS0006\xfe\x00\x00\xc3\x12/\x01aa \x00\x00d\xe0\n\x00\x00e\xe0\n\x00\x01ee\x02x3\x00\xc3\x130\x01aa\xe0\a\x00\x00b\xe0\b\x00\x00c\xe0\x00\x00\x01cc\x02x1\xff\x8f\xa2\xae٠Y\xa8N\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff",
+			expected:    "REDIS0006\xfe\x00\x00\xc3\x12/\x01aa \x00\x00d\xe0\n\x00\x00e\xe0\n\x00\x01ee\x02x3\x00\xc3\x130\x01aa\xe0\a\x00\x00b\xe0\b\x00\x00c\xe0\x00\x00\x01cc\x02x1\xff\x8f\xa2\xae٠Y\xa8N",
 			filter:      func(key string) bool { return strings.HasPrefix(key, "aaaa") },
 		},
+		{
+			description: "15: Modern RDB, no filtering",
+			rdb:         RDBFile6,
+			expected:    RDBFile6,
+			filter:      func(key string) bool { return true },
+		},
+		{
+			description: "16: Modern RDB, filter out b_",
+			rdb:         RDBFile6,
+			expected:    rdbWithCRC(RDBFile6Header + RDBFile6KeyA + RDBFile6ZsetA + "\xff"),
+			filter:      func(key string) bool { return strings.HasPrefix(key, "a_") },
+		},
+		{
+			description: "17: RDB with quicklists and listpacks, no filtering",
+			rdb:         RDBFile7,
+			expected:    RDBFile7,
+			filter:      func(key string) bool { return true },
+		},
+		{
+			description: "18: RDB with quicklists and listpacks, filter out b_",
+			rdb:         RDBFile7,
+			expected:    rdbWithCRC("REDIS0012\xfe\x00" + RDBFile7KeysA + "\xff"),
+			filter:      func(key string) bool { return strings.HasPrefix(key, "a_") },
+		},
+		{
+			description:   "19: Broken quicklist",
+			rdb:           "REDIS0012\xfe\x00\x12\x03a_l\x01\x03xyz",
+			expectedError: ErrUnsupportedOp,
+			filter:        func(key string) bool { return true },
+		},
+		{
+			description: "20: RDB with streams, no filtering",
+			rdb:         RDBFile8,
+			expected:    RDBFile8,
+			filter:      func(key string) bool { return true },
+		},
+		{
+			description: "21: RDB with streams, filter out b_",
+			rdb:         RDBFile8,
+			expected:    rdbWithCRC("REDIS0011\xfe\x00" + RDBFile8StreamA + "\xff"),
+			filter:      func(key string) bool { return strings.HasPrefix(key, "a_") },
+		},
+		{
+			description: "22: RDB with module values, no filtering",
+			rdb:         RDBFile9,
+			expected:    RDBFile9,
+			filter:      func(key string) bool { return true },
+		},
+		{
+			description: "23: RDB with module values, filter out b_",
+			rdb:         RDBFile9,
+			expected:    rdbWithCRC("REDIS0010\xfe\x00" + RDBFile9ModuleA + "\xff"),
+			filter:      func(key string) bool { return strings.HasPrefix(key, "a_") },
+		},
+		{
+			description:   "24: RDB with pre-GA module value",
+			rdb:           "REDIS0008\xfe\x00\x06\x03a_j\x81\x00\x00\x00\x00\x00\x00\x00\x01",
+			expectedError: ErrUnsupportedModule,
+			filter:        func(key string) bool { return true },
+		},
+		{
+			description:   "25: Broken module data",
+			rdb:           "REDIS0011\xf7\x81\x00\x00\x00\x00\x00\x00\x00\x01\x02\x02\x07",
+			expectedError: ErrUnsupportedModuleOp,
+			filter:        func(key string) bool { return true },
+		},
 	}
 
 	for _, test := range tests {
-		ch := make(chan []byte)
 		hadError := false
 
-		go func() {
-			err := FilterRDB(bufio.NewReader(bytes.NewBufferString(test.rdb)), ch, test.filter, int64(len(test.rdb)))
-			if err != nil {
-				if test.expectedError == nil || test.expectedError != err {
-					t.Errorf("Filtering failed (%s): %v", test.description, err)
-				} else {
-					hadError = true
-				}
-
+		received, err := collectRDB(func(ch chan<- []byte) error {
+			return FilterRDB(bufio.NewReader(bytes.NewBufferString(test.rdb)), ch, test.filter, int64(len(test.rdb)), nil)
+		})
+		if err != nil {
+			if test.expectedError == nil || test.expectedError != err {
+				t.Errorf("Filtering failed (%s): %v", test.description, err)
+			} else {
+				hadError = true
 			}
-			close(ch)
-		}()
+		}
 
-		received := ""
+		if test.expected != "" && test.expected != received {
+			t.Errorf("output not equal to expected: %#v != %#v (test %s)", test.expected, received, test.description)
+		}
 
-		for data := range ch {
-			received += string(data)
+		if test.expectedError != nil && !hadError {
+			t.Errorf("should have failed with error %v (%s)", test.expectedError, test.description)
 		}
+	}
 
-		if test.expected != "" && len(received) != len(test.rdb) {
-			t.Errorf("Size of filtered RDB doesn't match original size: %d != %d (test %s)", len(received), len(test.rdb), test.description)
+}
+
+func TestFilterRDBEOFMark(t *testing.T) {
+	mark := strings.Repeat("a", 40)
+
+	tests := []struct {
+		description   string
+		rdb           string
+		expected      string
+		expectedError error
+	}{
+		{
+			description: "1: Diskless RDB, filter out b_",
+			rdb:         RDBFile1 + mark,
+			expected:    "REDIS0006\xfe\x00\x00\x03a_1\x04lala\x00\x03a_2\xc0!\xff\xad}0`\xa6\xf4\xa1\xab",
+		},
+		{
+			description:   "2: Diskless RDB, wrong EOF mark",
+			rdb:           RDBFile1 + strings.Repeat("b", 40),
+			expectedError: ErrWrongEOFMark,
+		},
+		{
+			description:   "3: Diskless RDB, no EOF mark",
+			rdb:           RDBFile1,
+			expectedError: io.EOF,
+		},
+	}
+
+	for _, test := range tests {
+		received, err := collectRDB(func(ch chan<- []byte) error {
+			return FilterRDB(bufio.NewReader(bytes.NewBufferString(test.rdb)), ch, func(key string) bool { return strings.HasPrefix(key, "a_") }, -1, []byte(mark))
+		})
+
+		if err != test.expectedError {
+			t.Errorf("unexpected error: %v != %v (test %s)", err, test.expectedError, test.description)
 		}
 
 		if test.expected != "" && test.expected != received {
 			t.Errorf("output not equal to expected: %#v != %#v (test %s)", test.expected, received, test.description)
 		}
+	}
+}
 
-		if test.expectedError != nil && !hadError {
-			t.Errorf("should have failed with error %v (%s)", test.expectedError, test.description)
+func TestFilterRDBDatabases(t *testing.T) {
+	rdb := rdbWithCRC("REDIS0006\xfe\x00\x00\x03a_1\x01x\xfe\x01\x00\x03a_2\x01y\x00\x03b_1\x01z\xff")
+
+	tests := []struct {
+		description string
+		dbMap       map[int]int
+		transform   func(string) string
+		expected    string
+	}{
+		{
+			description: "0: Filter by database",
+			expected:    rdbWithCRC("REDIS0006\xfe\x00\xfe\x01\x00\x03a_2\x01y\xff"),
+		},
+		{
+			description: "1: Remap databases",
+			dbMap:       map[int]int{0: 3, 1: 300},
+			expected:    rdbWithCRC("REDIS0006\xfe\x03\xfe\x41\x2c\x00\x03a_2\x01y\xff"),
+		},
+		{
+			description: "2: Rename keys",
+			transform:   func(key string) string { return "tenant42:" + key[2:] },
+			expected:    rdbWithCRC("REDIS0006\xfe\x00\xfe\x01\x00\x0atenant42:2\x01y\xff"),
+		},
+	}
+
+	for _, test := range tests {
+		received, err := collectRDB(func(ch chan<- []byte) error {
+			output := NewRDBOutput(ch, func(db int, key string) bool { return db == 1 && strings.HasPrefix(key, "a_") })
+			output.dbMap = test.dbMap
+			output.transform = test.transform
+			return FilterRDBOutputs(bufio.NewReader(bytes.NewBufferString(rdb)), []*RDBOutput{output}, int64(len(rdb)), nil, nil)
+		})
+
+		if err != nil {
+			t.Errorf("unexpected error: %v (test %s)", err, test.description)
+		}
+
+		if test.expected != received {
+			t.Errorf("output not equal to expected: %#v != %#v (test %s)", test.expected, received, test.description)
 		}
 	}
+}
+
+func TestEncodeLength(t *testing.T) {
+	for _, length := range []uint64{0, 63, 64, 16383, 16384, 1 << 32, 1<<32 + 1} {
+		encoded := encodeLength(length)
 
+		filter := &RDBFilter{reader: bufio.NewReader(bytes.NewReader(encoded))}
+		decoded, encoding, err := filter.readLength()
+		if err != nil || encoding != -1 || decoded != length {
+			t.Errorf("encodeLength(%d) = %#v, decoded as %d, %d, %v", length, encoded, decoded, encoding, err)
+		}
+	}
 }
 
-func runRDBBenchmark(b *testing.B, filter func(string) bool) {
-	for i := 0; i < b.N; i++ {
-		ch := make(chan []byte)
+func TestFilterRDBProgress(t *testing.T) {
+	defer func(interval time.Duration) { rdbProgressInterval = interval }(rdbProgressInterval)
+	rdbProgressInterval = 0
 
-		go func() {
-			err := FilterRDB(bufio.NewReader(bytes.NewBufferString(RDBFile2)), ch, filter, int64(len(RDBFile2)))
-			close(ch)
-			if err != nil {
-				b.Fatalf("Unable to filter RDB: %v", err)
-			}
-		}()
+	var reports []RDBProgress
+
+	received, err := collectRDB(func(ch chan<- []byte) error {
+		output := NewRDBOutput(ch, func(db int, key string) bool { return strings.HasPrefix(key, "a_") })
+		return FilterRDBOutputs(bufio.NewReader(bytes.NewBufferString(RDBFile1)), []*RDBOutput{output}, int64(len(RDBFile1)), nil,
+			func(progress RDBProgress) { reports = append(reports, progress) })
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(reports) < 2 {
+		t.Fatalf("progress should be reported several times: %#v", reports)
+	}
+
+	for i := 1; i < len(reports); i++ {
+		if reports[i].Read < reports[i-1].Read || reports[i].Keys < reports[i-1].Keys {
+			t.Errorf("progress should be monotonic: %#v", reports)
+		}
+	}
+
+	last := reports[len(reports)-1]
+	if !last.Finished || last.Read != int64(len(RDBFile1)) || last.Length != int64(len(RDBFile1)) ||
+		last.Written != int64(len(received)) || last.Keys != 5 || last.KeptKeys != 2 {
+		t.Errorf("unexpected final progress: %#v", last)
+	}
+}
+
+func TestFilterRDBProgressLargeValue(t *testing.T) {
+	defer func(interval time.Duration) { rdbProgressInterval = interval }(rdbProgressInterval)
+	rdbProgressInterval = 0
+
+	value := strings.Repeat("x", 10*int(rdbProgressCheckBytes))
+	rdb := rdbWithCRC("REDIS0006\xfe\x00\x00\x03a_1" + string(encodeString(value)) + "\xff")
+
+	var reports []RDBProgress
+
+	_, err := collectRDB(func(ch chan<- []byte) error {
+		output := NewRDBOutput(ch, func(db int, key string) bool { return false })
+		return FilterRDBOutputs(bufio.NewReader(bytes.NewBufferString(rdb)), []*RDBOutput{output}, int64(len(rdb)), nil,
+			func(progress RDBProgress) { reports = append(reports, progress) })
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// progress is reported while value of the only key is skipped
+	during := 0
+	for _, progress := range reports {
+		if !progress.Finished && progress.Keys == 1 && progress.Read < int64(len(rdb)-1-8) {
+			during++
+		}
+	}
+
+	if during < 5 {
+		t.Errorf("progress should be reported while skipping large value: %#v", reports)
+	}
+}
+
+func TestRDBProgress(t *testing.T) {
+	tests := []struct {
+		progress RDBProgress
+		eta      time.Duration
+		etaOk    bool
+		expected string
+	}{
+		{
+			RDBProgress{Read: 256 << 20, Length: 1 << 30, Written: 64 << 20, Keys: 1000, KeptKeys: 250, Elapsed: 16 * time.Second},
+			48 * time.Second, true,
+			"read 256.0 MiB of 1.0 GiB (25.0%), written 64.0 MiB, keys 1000 (kept 250), 16.0 MiB/s, ETA 48s",
+		},
+		{
+			RDBProgress{Read: 512, Length: -1, Written: 100, Keys: 10, KeptKeys: 0, Elapsed: time.Second},
+			0, false,
+			"read 512 B, written 100 B, keys 10 (kept 0), 512 B/s",
+		},
+		{
+			RDBProgress{Read: 2048, Length: 2048, Written: 1024, Keys: 3, KeptKeys: 1, Elapsed: 1500 * time.Millisecond, Finished: true},
+			0, true,
+			"read 2.0 KiB of 2.0 KiB (100.0%), written 1.0 KiB, keys 3 (kept 1), 1.3 KiB/s, took 1.5s",
+		},
+		{
+			RDBProgress{Read: 0, Length: 100},
+			0, false,
+			"read 0 B of 100 B (0.0%), written 0 B, keys 0 (kept 0), 0 B/s",
+		},
+	}
 
-		for _ = range ch {
+	for _, test := range tests {
+		eta, ok := test.progress.ETA()
+		if eta != test.eta || ok != test.etaOk {
+			t.Errorf("ETA() = %v, %v != %v, %v", eta, ok, test.eta, test.etaOk)
 		}
 
+		if test.progress.String() != test.expected {
+			t.Errorf("String() = %#v != %#v", test.progress.String(), test.expected)
+		}
+	}
+}
+
+// Run filter in goroutine: filtered RDB is sent to returned channel, which is closed
+// when filter is done, result of filter is delivered to error channel afterwards
+func startRDBFilter(filter func(ch chan<- []byte) error) (<-chan []byte, <-chan error) {
+	ch := make(chan []byte)
+	errch := make(chan error, 1)
+
+	go func() {
+		err := filter(ch)
+		close(ch)
+		errch <- err
+	}()
+
+	return ch, errch
+}
+
+// Run filter, collecting filtered RDB into string
+func collectRDB(filter func(ch chan<- []byte) error) (string, error) {
+	ch, errch := startRDBFilter(filter)
+
+	result := ""
+	for data := range ch {
+		result += string(data)
+	}
+
+	return result, <-errch
+}
+
+// Filter RDB into string
+func filterRDBString(rdb string, dissector func(string) bool) string {
+	result, _ := collectRDB(func(ch chan<- []byte) error {
+		return FilterRDB(bufio.NewReader(bytes.NewBufferString(rdb)), ch, dissector, int64(len(rdb)), nil)
+	})
+	return result
+}
+
+// Append correct CRC64 to RDB contents
+func rdbWithCRC(rdb string) string {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, CRC64Update(0, []byte(rdb)))
+	return rdb + string(buf)
+}
+
+func runRDBBenchmark(b *testing.B, filter func(string) bool) {
+	for i := 0; i < b.N; i++ {
+		_, err := collectRDB(func(ch chan<- []byte) error {
+			return FilterRDB(bufio.NewReader(bytes.NewBufferString(RDBFile2)), ch, filter, int64(len(RDBFile2)), nil)
+		})
+		if err != nil {
+			b.Fatalf("Unable to filter RDB: %v", err)
+		}
 	}
 }
 
@@ -185,3 +477,43 @@ const (
 	RDBFile4 = "REDIS0006\xfe\x00\x00\xc1aS\x03cde\x00\xc0\x0c\x03abc\x00\xc2\x87\xd6\x12\x00\x03fgh\xff\xe9 \xb4\xe35e\x99\x92"
 	RDBFile5 = "REDIS0006\xfe\x00\x00\xc3\x12/\x01aa \x00\x00d\xe0\n\x00\x00e\xe0\n\x00\x01ee\x02x3\x00\xc3\x120\x01bb\xe0\x07\x00\x00a\xe0\t\x00\x00c\xc0\x00\x01cc\x02x2\x00\xc3\x130\x01aa\xe0\x07\x00\x00b\xe0\x08\x00\x00c\xe0\x00\x00\x01cc\x02x1\xff\x83J\xb9\xf9mX\x8a\xa6"
 )
+
+const (
+	RDBFile6Header = "REDIS0011\xfa\x09redis-ver\x057.2.4\xfa\x05ctime\xc2\x8e\xd6\x12\x65\xf5\x05hello" +
+		"\xf7\x81\x00\x00\x00\x00\x00\x00\x00\x01\x02\x02\x02\x05\x05\x03abc\x04\x00\x00\x00\x00\x00\x00\xf0\x3f\x00" +
+		"\xfe\x00\xfb\x03\x01"
+	RDBFile6KeyA  = "\xfc\x00\x00\x00\x00\x00\x00\x00\x01\xf9\x05\x00\x03a_1\x04lala"
+	RDBFile6KeyB  = "\xf8\x10\x00\x03b_1\x04kuku"
+	RDBFile6ZsetA = "\x05\x03a_z\x01\x01m\x00\x00\x00\x00\x00\x00\xf0\x3f"
+)
+
+const (
+	RDBFile7KeysA = "\x12\x03a_l\x02\x02\x05lp123\x01\x03xyz" +
+		"\x10\x03a_h\x03abc" +
+		"\x14\x03a_s\x01s" +
+		"\x16\x03a_m\x01\x00\x01f\x01v" +
+		"\x19\x03a_x\x00\x00\x00\x00\x00\x00\x00\x01\x02lp"
+	RDBFile7KeysB = "\x0e\x03b_q\x01\x04abcd" +
+		"\x11\x03b_z\x02zz" +
+		"\x18\x03b_m\x00\x00\x00\x00\x00\x00\x00\x01\x01\x05\x01f\x01v" +
+		"\x17\x03b_x\x02lp"
+)
+
+const (
+	RDBStreamID     = "\x00\x00\x01\x8f\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
+	RDBFile8StreamA = "\x15\x03a_s\x01\x10" + RDBStreamID + "\x04lpda" +
+		"\x02\x05\x00\x01\x00\x00\x00\x02" +
+		"\x01\x02g1\x05\x00\x02" +
+		"\x01" + RDBStreamID + "\x00\x00\x01\x8f\x00\x00\x00\x00\x01" +
+		"\x01\x02c1\x00\x00\x01\x8f\x00\x00\x00\x00\x00\x00\x01\x8f\x00\x00\x00\x00\x01" + RDBStreamID
+	RDBFile9ModuleA = "\x07\x03a_j\x81\x4b\x39\x98\x8f\x2c\xe7\x3c\x03\x05\x09{\"a\":\"b\"}\x02\x01\x00"
+	RDBFile9ModuleB = "\x07\x03b_f\x81\x4b\x39\x98\x8f\x2c\xe7\x3c\x03\x01\x05\x03\x00\x00\x80\x3f\x00"
+	RDBFile8StreamB = "\x0f\x03b_s\x01\x10" + RDBStreamID + "\x02lp\x01\x05\x00\x00"
+)
+
+var (
+	RDBFile6 = rdbWithCRC(RDBFile6Header + RDBFile6KeyA + RDBFile6KeyB + RDBFile6ZsetA + "\xff")
+	RDBFile7 = rdbWithCRC("REDIS0012\xfe\x00" + RDBFile7KeysB + RDBFile7KeysA + "\xff")
+	RDBFile8 = rdbWithCRC("REDIS0011\xfe\x00" + RDBFile8StreamB + RDBFile8StreamA + "\xff")
+	RDBFile9 = rdbWithCRC("REDIS0010\xfe\x00" + RDBFile9ModuleA + RDBFile9ModuleB + "\xff")
+)
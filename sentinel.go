@@ -0,0 +1,185 @@
+package main
+
+// Discovery of master with Redis Sentinel
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const sentinelTimeout = 5 * time.Second
+
+var (
+	// addresses of sentinels, if empty master address is taken from -master-host and -master-port
+	sentinelAddrs []string
+	// name of the master monitored by sentinels
+	sentinelMasterName string
+)
+
+// Read reply from sentinel: array elements (bulk strings, integers or simple strings) are returned
+// as strings, nil is returned for null reply
+func readSentinelReply(reader *bufio.Reader) ([]string, error) {
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	header = strings.TrimRight(header, "\r\n")
+
+	if len(header) == 0 {
+		return nil, fmt.Errorf("Empty reply from sentinel")
+	}
+
+	switch header[0] {
+	case '-':
+		return nil, fmt.Errorf("Sentinel replied with error: %s", header[1:])
+	case '+', ':':
+		return []string{header[1:]}, nil
+	case '$':
+		size, err := strconv.Atoi(header[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse bulk size: %v", err)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{string(data[:size])}, nil
+	case '*':
+		count, err := strconv.Atoi(header[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse array length: %v", err)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+
+		result := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			prefix, err := reader.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if prefix[0] == '*' {
+				return nil, fmt.Errorf("Unexpected nested reply from sentinel")
+			}
+
+			element, err := readSentinelReply(reader)
+			if err != nil {
+				return nil, err
+			}
+			if len(element) != 1 {
+				return nil, fmt.Errorf("Unexpected null element in reply from sentinel")
+			}
+			result = append(result, element[0])
+		}
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("Unexpected reply from sentinel: %#v", header)
+}
+
+// Ask single sentinel for address of the master
+func querySentinel(addr string) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, sentinelTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(sentinelTimeout))
+
+	_, err = conn.Write(encodeRedisCommand([]string{"SENTINEL", "get-master-addr-by-name", sentinelMasterName}))
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := readSentinelReply(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+
+	if len(reply) != 2 {
+		return "", fmt.Errorf("Master %s is unknown to sentinel", sentinelMasterName)
+	}
+
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// Find address of current master, asking sentinels one by one
+func resolveMaster() (string, error) {
+	var err error
+
+	for _, addr := range sentinelAddrs {
+		var master string
+
+		master, err = querySentinel(addr)
+		if err == nil {
+			return master, nil
+		}
+
+		log.Printf("Unable to get master address from sentinel %s: %v\n", addr, err)
+	}
+
+	return "", fmt.Errorf("None of sentinels knows address of master %s: %v", sentinelMasterName, err)
+}
+
+// Subscribe to failover notifications of single sentinel, returns when connection is broken
+func watchSentinel(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, sentinelTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(encodeRedisCommand([]string{"SUBSCRIBE", "+switch-master"}))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Watching for failover of master %s with sentinel %s\n", sentinelMasterName, addr)
+
+	reader := bufio.NewReader(conn)
+
+	for {
+		reply, err := readSentinelReply(reader)
+		if err != nil {
+			return err
+		}
+
+		if len(reply) != 3 || reply[0] != "message" {
+			continue
+		}
+
+		// <master name> <old ip> <old port> <new ip> <new port>
+		fields := strings.Fields(reply[2])
+		if len(fields) != 5 || fields[0] != sentinelMasterName {
+			continue
+		}
+
+		log.Printf("Master %s switched to %s\n", sentinelMasterName, net.JoinHostPort(fields[3], fields[4]))
+		reconnectLinks()
+	}
+}
+
+// Goroutine which follows failovers announced by sentinels
+func watchSentinels() {
+	for {
+		for _, addr := range sentinelAddrs {
+			err := watchSentinel(addr)
+			log.Printf("Lost connection to sentinel %s: %v\n", addr, err)
+		}
+
+		time.Sleep(reconnectDelay)
+	}
+}
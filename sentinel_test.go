@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadSentinelReply(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+		ok       bool
+	}{
+		{"*2\r\n$9\r\n127.0.0.1\r\n$4\r\n6379\r\n", []string{"127.0.0.1", "6379"}, true},
+		{"*-1\r\n", nil, true},
+		{"$-1\r\n", nil, true},
+		{"*3\r\n$9\r\nsubscribe\r\n$14\r\n+switch-master\r\n:1\r\n", []string{"subscribe", "+switch-master", "1"}, true},
+		{"+OK\r\n", []string{"OK"}, true},
+		{"-ERR unknown command\r\n", nil, false},
+		{"*1\r\n*1\r\n:1\r\n", nil, false},
+		{"*x\r\n", nil, false},
+		{"$5\r\nab", nil, false},
+	}
+
+	for _, test := range tests {
+		reply, err := readSentinelReply(bufio.NewReader(bytes.NewBufferString(test.input)))
+		if (err == nil) != test.ok || !reflect.DeepEqual(reply, test.expected) {
+			t.Errorf("readSentinelReply(%#v) = %#v, %v != %#v", test.input, reply, err, test.expected)
+		}
+	}
+}
+
+// fakeSentinel replies to SENTINEL get-master-addr-by-name and announces failovers to subscribers
+type fakeSentinel struct {
+	sync.Mutex
+	ln          net.Listener
+	master      string
+	subscribers []net.Conn
+}
+
+func startFakeSentinel(t *testing.T, master string) *fakeSentinel {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+
+	sentinel := &fakeSentinel{ln: ln, master: master}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go sentinel.serve(conn)
+		}
+	}()
+
+	return sentinel
+}
+
+func (sentinel *fakeSentinel) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	for {
+		command, err := readRedisCommand(reader)
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		switch strings.Join(command.command, " ") {
+		case "SENTINEL get-master-addr-by-name mymaster":
+			sentinel.Lock()
+			host, port, _ := net.SplitHostPort(sentinel.master)
+			sentinel.Unlock()
+			conn.Write(encodeRedisCommand([]string{host, port}))
+		case "SENTINEL get-master-addr-by-name unknown":
+			conn.Write([]byte("*-1\r\n"))
+		case "SUBSCRIBE +switch-master":
+			conn.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$14\r\n+switch-master\r\n:1\r\n"))
+			sentinel.Lock()
+			sentinel.subscribers = append(sentinel.subscribers, conn)
+			sentinel.Unlock()
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+// Announce failover to new master
+func (sentinel *fakeSentinel) switchMaster(master string) {
+	sentinel.Lock()
+	defer sentinel.Unlock()
+
+	oldHost, oldPort, _ := net.SplitHostPort(sentinel.master)
+	newHost, newPort, _ := net.SplitHostPort(master)
+	sentinel.master = master
+
+	message := fmt.Sprintf("mymaster %s %s %s %s", oldHost, oldPort, newHost, newPort)
+	for _, conn := range sentinel.subscribers {
+		conn.Write(encodeRedisCommand([]string{"message", "+switch-master", message}))
+	}
+}
+
+func (sentinel *fakeSentinel) close() {
+	sentinel.ln.Close()
+
+	sentinel.Lock()
+	defer sentinel.Unlock()
+
+	for _, conn := range sentinel.subscribers {
+		conn.Close()
+	}
+}
+
+func TestResolveMaster(t *testing.T) {
+	sentinel := startFakeSentinel(t, "10.0.0.1:6379")
+	defer sentinel.close()
+
+	// first sentinel is down
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+
+	sentinelAddrs = []string{down.Addr().String(), sentinel.ln.Addr().String()}
+	defer func() { sentinelAddrs, sentinelMasterName = nil, "" }()
+
+	sentinelMasterName = "mymaster"
+	addr, err := resolveMaster()
+	if err != nil || addr != "10.0.0.1:6379" {
+		t.Errorf("resolveMaster() = %#v, %v", addr, err)
+	}
+
+	sentinelMasterName = "unknown"
+	_, err = resolveMaster()
+	if err == nil {
+		t.Errorf("resolveMaster() should fail for unknown master")
+	}
+}
+
+func TestSentinelFailover(t *testing.T) {
+	const replID = "8de1787ba490483314a4d30f1c628bc5025eb761"
+
+	setA1 := string(encodeRedisCommand([]string{"SET", "a_1", "x"}))
+	setA2 := string(encodeRedisCommand([]string{"SET", "a_2", "z"}))
+
+	// old master performs full resynchronization and keeps connection open
+	master1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer master1.Close()
+
+	go func() {
+		conn, err := master1.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if expectCommand(t, reader, "REPLCONF", "capa", "eof", "capa", "psync2") {
+			conn.Write([]byte("+OK\r\n"))
+			if expectCommand(t, reader, "PSYNC", "?", "-1") {
+				conn.Write([]byte(fmt.Sprintf("+FULLRESYNC %s 100\r\n$%d\r\n%s", replID, len(RDBFile1), RDBFile1)))
+				conn.Write([]byte(setA1))
+			}
+		}
+		io.Copy(ioutil.Discard, reader)
+	}()
+
+	// new master continues replication
+	master2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer master2.Close()
+
+	go func() {
+		conn, err := master2.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		if expectCommand(t, reader, "REPLCONF", "capa", "eof", "capa", "psync2") {
+			conn.Write([]byte("+OK\r\n"))
+			if expectCommand(t, reader, "PSYNC", replID, strconv.Itoa(100+len(setA1)+1)) {
+				conn.Write([]byte("+CONTINUE\r\n" + setA2))
+			}
+		}
+		io.Copy(ioutil.Discard, reader)
+	}()
+
+	sentinel := startFakeSentinel(t, master1.Addr().String())
+	defer sentinel.close()
+
+	sentinelAddrs = []string{sentinel.ln.Addr().String()}
+	sentinelMasterName = "mymaster"
+	defer func() { sentinelAddrs, sentinelMasterName = nil, "" }()
+
+	reconnectDelay, reconnectMaxDelay = 10*time.Millisecond, 20*time.Millisecond
+
+	shardA := &shard{addr: "a", rules: []*filterRule{{regexp: regexp.MustCompile("^a_")}}}
+	shards = shardList{shardA}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go slaveReader(server, shardA)
+	reader := bufio.NewReader(client)
+
+	client.Write(encodeRedisCommand([]string{"SYNC"}))
+
+	rdbA := filterRDBString(RDBFile1, func(key string) bool { return strings.HasPrefix(key, "a_") })
+	expectData(t, reader, fmt.Sprintf("$%d\r\n%s", len(rdbA), rdbA))
+	expectData(t, reader, setA1)
+
+	go watchSentinel(sentinel.ln.Addr().String())
+
+	// wait for subscription before announcing failover
+	for i := 0; i < 100; i++ {
+		sentinel.Lock()
+		subscribed := len(sentinel.subscribers) > 0
+		sentinel.Unlock()
+
+		if subscribed {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sentinel.switchMaster(master2.Addr().String())
+
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			t.Fatalf("Unable to read: %v", err)
+		}
+		if b != '\n' {
+			reader.UnreadByte()
+			break
+		}
+	}
+
+	expectData(t, reader, setA2)
+}
@@ -0,0 +1,219 @@
+package main
+
+// Shards: listening addresses for slaves, each with its own filter for keys
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// filterRule selects keys: key should match regular expression, belong
+// to one of hash slots and to one of databases (if any of those is configured)
+type filterRule struct {
+	regexp    *regexp.Regexp
+	slots     *slotSet
+	databases map[int]bool
+}
+
+// shard is an address slaves connect to, key passes shard filter if it matches any of the rules,
+// offsets of the last slave are kept for partial resynchronization when slave reconnects
+type shard struct {
+	sync.Mutex
+	addr    string
+	rules   []*filterRule
+	offsets *offsetMap
+}
+
+// Check whether key from database db matches the rule
+func (rule *filterRule) match(db int, key string) bool {
+	if rule.databases != nil && !rule.databases[db] {
+		return false
+	}
+
+	if rule.regexp != nil && rule.regexp.FindStringIndex(key) == nil {
+		return false
+	}
+
+	if rule.slots != nil && !rule.slots.matchKey(key) {
+		return false
+	}
+
+	return true
+}
+
+// Format rule as list of conditions, as in -shard option
+func (rule *filterRule) String() string {
+	var conditions []string
+
+	if rule.regexp != nil {
+		conditions = append(conditions, rule.regexp.String())
+	}
+
+	if rule.slots != nil {
+		conditions = append(conditions, "slots="+rule.slots.String())
+	}
+
+	if rule.databases != nil {
+		databases := make([]int, 0, len(rule.databases))
+		for db := range rule.databases {
+			databases = append(databases, db)
+		}
+		sort.Ints(databases)
+
+		list := make([]string, len(databases))
+		for i, db := range databases {
+			list[i] = strconv.Itoa(db)
+		}
+		conditions = append(conditions, "db="+strings.Join(list, ","))
+	}
+
+	return strings.Join(conditions, " ")
+}
+
+// Parse filter rule from list of conditions: regular expression, slots=<ranges> and/or db=<list>
+func parseFilterRule(conditions []string) (*filterRule, error) {
+	rule := &filterRule{}
+
+	for _, condition := range conditions {
+		var err error
+
+		if strings.HasPrefix(condition, "slots=") {
+			rule.slots, err = parseSlots(condition[6:])
+			if err != nil {
+				return nil, err
+			}
+		} else if strings.HasPrefix(condition, "db=") {
+			rule.databases, err = parseDatabases(condition[3:])
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			if rule.regexp != nil {
+				return nil, fmt.Errorf("Only one regular expression is allowed per rule: %#v", condition)
+			}
+			rule.regexp, err = regexp.Compile(condition)
+			if err != nil {
+				return nil, fmt.Errorf("Wrong format of regular expression: %v", err)
+			}
+		}
+	}
+
+	if rule.regexp == nil && rule.slots == nil && rule.databases == nil {
+		return nil, fmt.Errorf("Rule should contain regular expression, hash slots or databases")
+	}
+
+	return rule, nil
+}
+
+// Parse comma-separated list of database numbers
+func parseDatabases(list string) (map[int]bool, error) {
+	result := make(map[int]bool)
+
+	for _, item := range strings.Split(list, ",") {
+		db, err := strconv.Atoi(item)
+		if err != nil || db < 0 {
+			return nil, fmt.Errorf("Wrong database number: %#v", item)
+		}
+		result[db] = true
+	}
+
+	return result, nil
+}
+
+// Parse database map "from:to,..."
+func parseDBMap(list string) (map[int]int, error) {
+	result := make(map[int]int)
+
+	for _, item := range strings.Split(list, ",") {
+		pair := strings.Split(item, ":")
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("Database mapping should be specified as \"from:to\": %#v", item)
+		}
+
+		from, err := strconv.Atoi(pair[0])
+		if err != nil || from < 0 {
+			return nil, fmt.Errorf("Wrong database number: %#v", pair[0])
+		}
+
+		to, err := strconv.Atoi(pair[1])
+		if err != nil || to < 0 {
+			return nil, fmt.Errorf("Wrong database number: %#v", pair[1])
+		}
+
+		if _, exists := result[from]; exists {
+			return nil, fmt.Errorf("Database %d is mapped twice", from)
+		}
+		result[from] = to
+	}
+
+	return result, nil
+}
+
+// Check whether key from database db should be passed to slaves of the shard
+func (s *shard) match(db int, key string) bool {
+	for _, rule := range s.rules {
+		if rule.match(db, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remember offsets of the slave attached to the shard
+func (s *shard) setOffsets(offsets *offsetMap) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.offsets = offsets
+}
+
+// Offsets of the last slave attached to the shard, nil if none
+func (s *shard) lastOffsets() *offsetMap {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.offsets
+}
+
+// shardList collects shards from command-line flags
+type shardList []*shard
+
+// List of all configured shards
+var shards shardList
+
+func (l *shardList) String() string {
+	addrs := make([]string, len(*l))
+	for i, s := range *l {
+		addrs[i] = s.addr
+	}
+	return strings.Join(addrs, ",")
+}
+
+// Set parses shard definition "[host:]port condition...", each definition adds
+// filter rule, so several definitions with the same address are combined with OR
+func (l *shardList) Set(spec string) error {
+	fields := strings.Fields(spec)
+	if len(fields) < 2 {
+		return fmt.Errorf("Shard should be specified as \"[host:]port condition...\": %#v", spec)
+	}
+
+	rule, err := parseFilterRule(fields[1:])
+	if err != nil {
+		return err
+	}
+
+	for _, s := range *l {
+		if s.addr == fields[0] {
+			s.rules = append(s.rules, rule)
+			return nil
+		}
+	}
+
+	*l = append(*l, &shard{addr: fields[0], rules: []*filterRule{rule}})
+	return nil
+}
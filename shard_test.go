@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShardList(t *testing.T) {
+	var l shardList
+
+	for _, spec := range []string{"6401 ^a", "6402 slots=0-8191", "6401 ^b slots=3443", "127.0.0.1:6403 ^c", "6404 db=1,2", "6404 ^d db=0"} {
+		err := l.Set(spec)
+		if err != nil {
+			t.Fatalf("Unable to parse shard %#v: %v", spec, err)
+		}
+	}
+
+	if l.String() != "6401,6402,127.0.0.1:6403,6404" {
+		t.Errorf("Unexpected shards: %s", l.String())
+	}
+
+	if l[0].rules[1].String() != "^b slots=3443" || l[3].rules[0].String() != "db=1,2" {
+		t.Errorf("Unexpected rules: %s, %s", l[0].rules[1], l[3].rules[0])
+	}
+
+	tests := []struct {
+		shard    int
+		db       int
+		key      string
+		expected bool
+	}{
+		{0, 0, "apple", true},
+		{0, 0, "banana", false},
+		{0, 0, "buser1000", false},
+		{0, 0, "b{user1000}", true},
+		{0, 5, "apple", true},
+		{1, 0, "bar", true},
+		{1, 0, "foo", false},
+		{2, 0, "cucumber", true},
+		{2, 0, "apple", false},
+		{3, 0, "apple", false},
+		{3, 0, "dog", true},
+		{3, 1, "apple", true},
+		{3, 2, "dog", true},
+		{3, 3, "dog", false},
+	}
+
+	for _, test := range tests {
+		if l[test.shard].match(test.db, test.key) != test.expected {
+			t.Errorf("shard %s match(%d, %#v) != %v", l[test.shard].addr, test.db, test.key, test.expected)
+		}
+	}
+
+	for _, spec := range []string{"6401", "6401 slots=x", "6401 ^a ^b", "6401 (", "6401 db=x", "6401 db=-1"} {
+		err := l.Set(spec)
+		if err == nil {
+			t.Errorf("Parsing shard %#v should fail", spec)
+		}
+	}
+}
+
+func TestParseDBMap(t *testing.T) {
+	mapping, err := parseDBMap("0:3,1:4")
+	if err != nil {
+		t.Fatalf("Unable to parse database map: %v", err)
+	}
+
+	if !reflect.DeepEqual(mapping, map[int]int{0: 3, 1: 4}) {
+		t.Errorf("Unexpected database map: %#v", mapping)
+	}
+
+	for _, list := range []string{"", "0", "0:x", "x:0", "0:1:2", "0:1,0:2", "-1:0"} {
+		_, err = parseDBMap(list)
+		if err == nil {
+			t.Errorf("Parsing database map %#v should fail", list)
+		}
+	}
+}
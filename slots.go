@@ -0,0 +1,90 @@
+package main
+
+// Hash slots as in Redis Cluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const clusterSlots = 16384
+
+// slotSet is a set of hash slots
+type slotSet [clusterSlots]bool
+
+// Calculate hash slot of the key exactly as Redis Cluster: if key contains
+// non-empty {hashtag}, only hashtag is hashed
+func keyHashSlot(key string) int {
+	start := strings.IndexByte(key, '{')
+	if start != -1 {
+		end := strings.IndexByte(key[start+1:], '}')
+		if end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(CRC16([]byte(key)) & (clusterSlots - 1))
+}
+
+// Parse list of slots and slot ranges, e.g. "0-8191,10000"
+func parseSlots(spec string) (*slotSet, error) {
+	result := &slotSet{}
+
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse slot %#v: %v", part, err)
+		}
+
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("Unable to parse slot %#v: %v", part, err)
+			}
+		}
+
+		if start < 0 || end >= clusterSlots || start > end {
+			return nil, fmt.Errorf("Wrong slot range %#v, slots should be in range 0-%d", part, clusterSlots-1)
+		}
+
+		for slot := start; slot <= end; slot++ {
+			result[slot] = true
+		}
+	}
+
+	return result, nil
+}
+
+// Format set as list of slots and slot ranges, e.g. "0-8191,10000"
+func (slots *slotSet) String() string {
+	var ranges []string
+
+	for start := 0; start < clusterSlots; start++ {
+		if !slots[start] {
+			continue
+		}
+
+		end := start
+		for end+1 < clusterSlots && slots[end+1] {
+			end++
+		}
+
+		if start == end {
+			ranges = append(ranges, strconv.Itoa(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+		}
+		start = end
+	}
+
+	return strings.Join(ranges, ",")
+}
+
+// Check whether key belongs to one of the slots in set
+func (slots *slotSet) matchKey(key string) bool {
+	return slots[keyHashSlot(key)]
+}
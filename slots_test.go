@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestKeyHashSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"foo", 12182},
+		{"bar", 5061},
+		{"{user1000}.following", 3443},
+		{"{user1000}.followers", 3443},
+		{"user1000", 3443},
+		{"foo{}{bar}", keyHashSlot("foo{}{bar}")},
+		{"foo{{bar}}zap", keyHashSlot("{bar")},
+		{"foo{bar}{zap}", keyHashSlot("bar")},
+	}
+
+	for _, test := range tests {
+		slot := keyHashSlot(test.key)
+		if slot != test.slot {
+			t.Errorf("keyHashSlot(%#v) = %d != %d", test.key, slot, test.slot)
+		}
+	}
+
+	if keyHashSlot("foo{}{bar}") == keyHashSlot("bar") {
+		t.Errorf("empty hashtag should be ignored")
+	}
+}
+
+func TestParseSlots(t *testing.T) {
+	slots, err := parseSlots("0-100,5000, 16383")
+	if err != nil {
+		t.Fatalf("Unable to parse slots: %v", err)
+	}
+
+	for slot, expected := range map[int]bool{0: true, 100: true, 101: false, 4999: false, 5000: true, 5001: false, 16383: true} {
+		if slots[slot] != expected {
+			t.Errorf("slot %d in set: %v != %v", slot, slots[slot], expected)
+		}
+	}
+
+	if slots.String() != "0-100,5000,16383" {
+		t.Errorf("Unexpected slots: %s", slots.String())
+	}
+
+	slots, _ = parseSlots("3443")
+	if !slots.matchKey("{user1000}.following") || slots.matchKey("foo") {
+		t.Errorf("matchKey doesn't match slots")
+	}
+
+	for _, spec := range []string{"", "a", "0-b", "100-0", "0-16384", "-1"} {
+		_, err = parseSlots(spec)
+		if err == nil {
+			t.Errorf("parseSlots(%#v) should fail", spec)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+// TLS for connection to master and for slaves connecting to proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+)
+
+var (
+	// TLS configuration for connection to master, nil if TLS is disabled
+	masterTLSConfig *tls.Config
+	// TLS configuration for proxy listener, nil if TLS is disabled
+	proxyTLSConfig *tls.Config
+)
+
+// Load pool of CA certificates from PEM file
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}
+
+// Build TLS configuration for connection to master: caFile is used to verify master certificate (system CAs
+// if empty), certFile and keyFile is client certificate (if master requires one), serverName overrides
+// name used for SNI and verification, skipVerify disables verification of master certificate
+func newMasterTLSConfig(caFile, certFile, keyFile, serverName string, skipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Build TLS configuration for proxy listener: certFile and keyFile is proxy certificate, if caFile is
+// set, slaves are required to present client certificate signed by that CA
+func newProxyTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// Connect to master (asking sentinels for its address if configured), using TLS if configured
+func dialMaster() (net.Conn, error) {
+	addr := net.JoinHostPort(masterHost, strconv.Itoa(masterPort))
+
+	if len(sentinelAddrs) > 0 {
+		var err error
+		addr, err = resolveMaster()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if masterTLSConfig == nil {
+		return net.Dial("tcp", addr)
+	}
+
+	config := masterTLSConfig
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	return tls.Dial("tcp", addr, config)
+}
+
+// Listen for slaves, using TLS if configured
+func listen(addr string) (net.Listener, error) {
+	if proxyTLSConfig == nil {
+		return net.Listen("tcp", addr)
+	}
+
+	return tls.Listen("tcp", addr, proxyTLSConfig)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Generate certificate signed by parent (self-signed if parent is nil), writing certificate and key to dir
+func generateCert(t *testing.T, dir, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Unable to parse certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Unable to marshal key: %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-resharding-proxy-tls")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := generateCert(t, dir, "ca", true, nil, nil)
+	generateCert(t, dir, "server", false, ca, caKey)
+	generateCert(t, dir, "client", false, ca, caKey)
+	generateCert(t, dir, "other", true, nil, nil)
+
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	proxyTLSConfig, err = newProxyTLSConfig(file("server.crt"), file("server.key"), file("ca.crt"))
+	defer func() { proxyTLSConfig, masterTLSConfig = nil, nil }()
+	if err != nil {
+		t.Fatalf("Unable to configure TLS listener: %v", err)
+	}
+
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	defer ln.Close()
+
+	masterHost = "127.0.0.1"
+	masterPort = ln.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				buf := make([]byte, 7)
+				if _, err := conn.Read(buf); err == nil {
+					conn.Write([]byte("+PONG\r\n"))
+				}
+			}()
+		}
+	}()
+
+	tests := []struct {
+		description                 string
+		ca, cert, key, serverName   string
+		skipVerify, expectedFailure bool
+	}{
+		{"0: CA and client certificate", file("ca.crt"), file("client.crt"), file("client.key"), "", false, false},
+		{"1: Server name", file("ca.crt"), file("client.crt"), file("client.key"), "localhost", false, false},
+		{"2: Wrong server name", file("ca.crt"), file("client.crt"), file("client.key"), "redis.example.com", false, true},
+		{"3: Unknown CA", file("other.crt"), file("client.crt"), file("client.key"), "", false, true},
+		{"4: Skip verification", file("other.crt"), file("client.crt"), file("client.key"), "", true, false},
+		{"5: No client certificate", file("ca.crt"), "", "", "", false, true},
+	}
+
+	for _, test := range tests {
+		masterTLSConfig, err = newMasterTLSConfig(test.ca, test.cert, test.key, test.serverName, test.skipVerify)
+		if err != nil {
+			t.Fatalf("Unable to configure TLS for master: %v (test %s)", err, test.description)
+		}
+
+		conn, err := dialMaster()
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			_, err = conn.Write([]byte("PING\r\n\r\n"))
+			if err == nil {
+				buf := make([]byte, 7)
+				_, err = conn.Read(buf)
+				if err == nil && string(buf) != "+PONG\r\n" {
+					t.Errorf("Unexpected reply: %#v (test %s)", string(buf), test.description)
+				}
+			}
+			conn.Close()
+		}
+
+		if test.expectedFailure && err == nil {
+			t.Errorf("TLS connection should fail (test %s)", test.description)
+		} else if !test.expectedFailure && err != nil {
+			t.Errorf("Unexpected error: %v (test %s)", err, test.description)
+		}
+	}
+
+	_, err = newProxyTLSConfig(file("missing.crt"), file("missing.key"), "")
+	if err == nil {
+		t.Errorf("Loading missing certificate should fail")
+	}
+}